@@ -0,0 +1,136 @@
+// Command mailpreview renders predefined mail templates with sample models,
+// reports variables which are missing in models or unused by templates
+// and writes HTML and text previews. It does not use network, so it may run in CI:
+//
+//	go run ./cmd/mailpreview -out mail_preview
+//	go run ./cmd/mailpreview -templates ./mail/templates -locale de -strict -out ""
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dittotrade/internal/mail"
+)
+
+// previewConfig provides product details of previews
+var previewConfig = mail.Config{
+	ProductName:    "Ditto Trade",
+	ProductURL:     "https://ditto.trade",
+	SupportURL:     "https://ditto.trade/support",
+	SupportEmail:   "support@ditto.trade",
+	CompanyName:    "Ditto Trade Pty Limited",
+	CompanyAddress: "Level 27, 25 Bligh Street, Sydney NSW 2000",
+	FromEmail:      "notifications@ditto.trade",
+	FromName:       "Ditto Trade",
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "mailpreview:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("mailpreview", flag.ContinueOnError)
+	out := flags.String("out", "mail_preview", "directory of previews, empty disables writing")
+	dir := flags.String("templates", "", "directory of templates, embedded templates are used if empty")
+	locale := flags.String("locale", "", "locale of previews, e.g. de")
+	strict := flags.Bool("strict", false, "fail on model variables unused by templates")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	templates := mail.DefaultTemplates()
+	if *dir != "" {
+		var err error
+		if templates, err = mail.LoadTemplates(os.DirFS(*dir)); err != nil {
+			return err
+		}
+	}
+	cfg := previewConfig
+	if *locale != "" {
+		cfg.Locales = map[string]mail.LocaleConfig{*locale: {}}
+	}
+	s := mail.New(mail.NewOutbox(), cfg, mail.WithTemplates(templates))
+	if *out != "" {
+		if err := os.MkdirAll(*out, 0o755); err != nil {
+			return err
+		}
+	}
+
+	var failed []string
+	for _, alias := range templates.Aliases() {
+		if strings.Contains(alias, ".") {
+			// translations are previewed with -locale
+			continue
+		}
+		ok, err := preview(w, s, alias, *locale, *out, *strict)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			failed = append(failed, alias)
+		}
+	}
+	samples := make([]string, 0, len(mail.SampleModels))
+	for alias := range mail.SampleModels {
+		samples = append(samples, alias)
+	}
+	sort.Strings(samples)
+	for _, alias := range samples {
+		if !templates.Has(alias) {
+			fmt.Fprintf(w, "FAIL %s: sample model has no template\n", alias)
+			failed = append(failed, alias)
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New("templates do not match models: " + strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// preview checks template alias against its sample model and writes previews into out directory
+func preview(w io.Writer, s *mail.Service, alias, locale, out string, strict bool) (bool, error) {
+	model, ok := mail.SampleModels[alias]
+	if !ok {
+		fmt.Fprintf(w, "FAIL %s: no sample model\n", alias)
+		return false, nil
+	}
+	email, report, err := s.Preview(alias, model, mail.WithLocale(locale))
+	if err != nil {
+		return false, err
+	}
+	ok = report.OK() && (!strict || len(report.Unused) == 0)
+	status := "ok  "
+	if !ok {
+		status = "FAIL"
+	}
+	fmt.Fprintf(w, "%s %s\n", status, report.Template)
+	if len(report.Missing) > 0 {
+		fmt.Fprintf(w, "     missing: %s\n", strings.Join(report.Missing, ", "))
+	}
+	if len(report.Unused) > 0 {
+		fmt.Fprintf(w, "     unused: %s\n", strings.Join(report.Unused, ", "))
+	}
+	if out == "" || !report.OK() {
+		return ok, nil
+	}
+	if err = os.WriteFile(filepath.Join(out, report.Template+".html"), []byte(email.HTMLBody), 0o644); err != nil {
+		return false, err
+	}
+	if email.TextBody != "" {
+		text := "Subject: " + email.Subject + "\n\n" + email.TextBody
+		if err = os.WriteFile(filepath.Join(out, report.Template+".txt"), []byte(text), 0o644); err != nil {
+			return false, err
+		}
+	}
+	return ok, nil
+}
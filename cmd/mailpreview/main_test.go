@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	out := t.TempDir()
+	var buf bytes.Buffer
+	require.NoError(t, run([]string{"-out", out, "-strict"}, &buf))
+	require.Contains(t, buf.String(), "ok   stop_loss\n")
+	require.NotContains(t, buf.String(), "FAIL")
+
+	html, err := os.ReadFile(filepath.Join(out, "stop_loss.html"))
+	require.NoError(t, err)
+	require.Contains(t, string(html), "Momentum FX")
+	text, err := os.ReadFile(filepath.Join(out, "verification_code.txt"))
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(text), "Subject: "))
+}
+
+func TestRun_Mismatch(t *testing.T) {
+	dir := t.TempDir()
+	tmpl := filepath.Join(dir, "stop_loss")
+	require.NoError(t, os.Mkdir(tmpl, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpl, "subject.txt"), []byte("Stop loss {{.strategy}}"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpl, "body.html"),
+		[]byte("<p>{{.strategy_name}} {{.equity_formatted}} {{.stop_loss_formatted}}</p>"), 0o644))
+
+	var buf bytes.Buffer
+	err := run([]string{"-templates", dir, "-out", ""}, &buf)
+	require.Error(t, err)
+	require.Contains(t, buf.String(), "FAIL stop_loss\n     missing: strategy\n     unused: strategy_id\n")
+	// predefined templates absent in the directory are reported
+	require.Contains(t, buf.String(), "FAIL verification_code: sample model has no template")
+}
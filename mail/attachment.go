@@ -0,0 +1,205 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+
+	"github.com/keighl/postmark"
+)
+
+// DefaultMaxAttachmentsSize is used when Config.MaxAttachmentsSize is not set.
+// Postmark limits message size to 10 MB including base64 encoded attachments.
+const DefaultMaxAttachmentsSize = 7 << 20
+
+// ErrAttachmentTooLarge means attachments exceed Config.MaxAttachmentsSize, never retry
+var ErrAttachmentTooLarge = errors.New("attachments are too large")
+
+// Attachment is a file sent along with email, see WithAttachments
+type Attachment struct {
+	Name string
+	// ContentType is MIME type, application/octet-stream by default
+	ContentType string
+	// Content of the file, it is read from Reader if Reader is set
+	Content []byte
+	Reader  io.Reader `json:"-"`
+	// ContentID makes attachment an inline image referenced from HTML body as cid:<ContentID>
+	ContentID string `json:",omitempty"`
+}
+
+// readAttachments reads contents of attachments checking total size against limit
+func readAttachments(attachments []Attachment, limit int64) ([]Attachment, error) {
+	if len(attachments) == 0 {
+		return nil, nil
+	}
+	res := make([]Attachment, len(attachments))
+	var total int64
+	for i, a := range attachments {
+		if a.Name == "" {
+			return nil, fmt.Errorf("attachment %d has no name", i)
+		}
+		if a.Reader != nil {
+			data, err := io.ReadAll(io.LimitReader(a.Reader, limit-total+1))
+			if err != nil {
+				return nil, fmt.Errorf("could not read attachment %s: %w", a.Name, err)
+			}
+			a.Content, a.Reader = data, nil
+		}
+		if a.ContentType == "" {
+			a.ContentType = "application/octet-stream"
+		}
+		if _, _, err := mime.ParseMediaType(a.ContentType); err != nil {
+			return nil, fmt.Errorf("attachment %s has invalid content type %q: %w", a.Name, a.ContentType, err)
+		}
+		if total += int64(len(a.Content)); total > limit {
+			return nil, fmt.Errorf("%w: limit is %d bytes", ErrAttachmentTooLarge, limit)
+		}
+		res[i] = a
+	}
+	return res, nil
+}
+
+// maxAttachmentsSize returns configured limit or DefaultMaxAttachmentsSize
+func (s *Service) maxAttachmentsSize() int64 {
+	if s.config.MaxAttachmentsSize <= 0 {
+		return DefaultMaxAttachmentsSize
+	}
+	return s.config.MaxAttachmentsSize
+}
+
+func postmarkAttachments(attachments []Attachment) []postmark.Attachment {
+	if len(attachments) == 0 {
+		return nil
+	}
+	res := make([]postmark.Attachment, len(attachments))
+	for i, a := range attachments {
+		res[i] = postmark.Attachment{
+			Name:        a.Name,
+			Content:     base64.StdEncoding.EncodeToString(a.Content),
+			ContentType: a.ContentType,
+			ContentID:   a.ContentID,
+		}
+	}
+	return res
+}
+
+// mimePart is MIME entity of SMTP message
+type mimePart struct {
+	header textproto.MIMEHeader
+	write  func(w io.Writer) error
+}
+
+func textPart(contentType, body string) mimePart {
+	return mimePart{
+		header: textproto.MIMEHeader{
+			"Content-Type":              {contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		},
+		write: func(w io.Writer) error {
+			return writeQuotedPrintable(w, body)
+		},
+	}
+}
+
+func multipartPart(subtype string, parts ...mimePart) mimePart {
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	return mimePart{
+		header: textproto.MIMEHeader{"Content-Type": {"multipart/" + subtype + "; boundary=" + boundary}},
+		write: func(w io.Writer) error {
+			mw := multipart.NewWriter(w)
+			if err := mw.SetBoundary(boundary); err != nil {
+				return err
+			}
+			for _, p := range parts {
+				pw, err := mw.CreatePart(p.header)
+				if err != nil {
+					return err
+				}
+				if err = p.write(pw); err != nil {
+					return err
+				}
+			}
+			return mw.Close()
+		},
+	}
+}
+
+// attachmentPart keeps parameters of content type, e.g. charset, and adds name of the file
+func attachmentPart(a Attachment) (mimePart, error) {
+	mediaType, params, err := mime.ParseMediaType(a.ContentType)
+	if err != nil {
+		return mimePart{}, fmt.Errorf("attachment %s has invalid content type %q: %w", a.Name, a.ContentType, err)
+	}
+	params["name"] = a.Name
+	contentType := mime.FormatMediaType(mediaType, params)
+	disposition := "attachment"
+	if a.ContentID != "" {
+		disposition = "inline"
+	}
+	disposition = mime.FormatMediaType(disposition, map[string]string{"filename": a.Name})
+	if contentType == "" || disposition == "" {
+		return mimePart{}, fmt.Errorf("could not encode headers of attachment %s", a.Name)
+	}
+	header := textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {disposition},
+	}
+	if a.ContentID != "" {
+		header.Set("Content-ID", "<"+a.ContentID+">")
+	}
+	return mimePart{
+		header: header,
+		write: func(w io.Writer) error {
+			encoded := base64.StdEncoding.EncodeToString(a.Content)
+			var buf bytes.Buffer
+			// RFC 2045 limits encoded lines to 76 characters
+			for len(encoded) > 76 {
+				buf.WriteString(encoded[:76] + "\r\n")
+				encoded = encoded[76:]
+			}
+			buf.WriteString(encoded)
+			_, err := w.Write(buf.Bytes())
+			return err
+		},
+	}, nil
+}
+
+// messageBody returns MIME structure of bodies and attachments:
+// mixed(related(alternative(text, html), inline images), attachments)
+// where every level is omitted when it has a single part
+func messageBody(htmlBody, textBody string, attachments []Attachment) (mimePart, error) {
+	var body mimePart
+	switch {
+	case htmlBody == "":
+		body = textPart("text/plain", textBody)
+	case textBody == "":
+		body = textPart("text/html", htmlBody)
+	default:
+		body = multipartPart("alternative", textPart("text/plain", textBody), textPart("text/html", htmlBody))
+	}
+	var inline, attached []mimePart
+	for _, a := range attachments {
+		part, err := attachmentPart(a)
+		if err != nil {
+			return mimePart{}, err
+		}
+		if a.ContentID != "" && htmlBody != "" {
+			inline = append(inline, part)
+		} else {
+			attached = append(attached, part)
+		}
+	}
+	if len(inline) > 0 {
+		body = multipartPart("related", append([]mimePart{body}, inline...)...)
+	}
+	if len(attached) > 0 {
+		body = multipartPart("mixed", append([]mimePart{body}, attached...)...)
+	}
+	return body, nil
+}
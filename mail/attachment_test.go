@@ -0,0 +1,125 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keighl/postmark"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_Attachments(t *testing.T) {
+	outbox := NewOutbox()
+	cfg := testConfig
+	cfg.MaxAttachmentsSize = 10
+	s := New(outbox, cfg)
+	ctx := context.TODO()
+
+	_, err := s.Send(ctx, "statement", "statement", "investor@ditto.trade", nil,
+		WithAttachments(Attachment{Name: "statement.pdf", Reader: strings.NewReader("0123456789ABC")}))
+	require.ErrorIs(t, err, ErrAttachmentTooLarge)
+	require.Zero(t, outbox.Len())
+
+	_, err = s.Send(ctx, "statement", "statement", "investor@ditto.trade", nil,
+		WithAttachments(Attachment{Name: "statement.pdf", ContentType: "application pdf", Content: []byte("%PDF")}))
+	require.Error(t, err)
+	require.Zero(t, outbox.Len())
+
+	_, err = s.Send(ctx, "statement", "statement", "investor@ditto.trade", nil,
+		WithAttachments(Attachment{Name: "statement.pdf", ContentType: "application/pdf",
+			Reader: strings.NewReader("%PDF-1.4")}))
+	require.NoError(t, err)
+	email, _ := outbox.Last()
+	require.Len(t, email.Attachments, 1)
+	require.Equal(t, []byte("%PDF-1.4"), email.Attachments[0].Content)
+	require.Nil(t, email.Attachments[0].Reader)
+}
+
+func TestPostmarkTransport_Attachments(t *testing.T) {
+	var got postmark.TemplatedEmail
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		_ = json.NewEncoder(w).Encode(postmark.EmailResponse{To: got.To, MessageID: "message-id"})
+	}))
+	defer srv.Close()
+	tr := NewPostmarkTransport("server-token", "account-token")
+	tr.client.BaseURL = srv.URL
+
+	_, err := tr.Send(context.TODO(), Email{TemplateAlias: "statement", To: "investor@ditto.trade",
+		Attachments: []Attachment{{Name: "logo.png", ContentType: "image/png", Content: []byte{0x89, 'P'},
+			ContentID: "logo"}}})
+	require.NoError(t, err)
+	require.Len(t, got.Attachments, 1)
+	require.Equal(t, base64.StdEncoding.EncodeToString([]byte{0x89, 'P'}), got.Attachments[0].Content)
+	require.Equal(t, "logo", got.Attachments[0].ContentID)
+}
+
+func TestBuildMessage_Attachments(t *testing.T) {
+	pdf := bytes.Repeat([]byte("statement "), 20)
+	msg, err := buildMessage(Email{From: "a@ditto.trade", To: "b@ditto.trade", Attachments: []Attachment{
+		{Name: "logo.png", ContentType: "image/png", Content: []byte("png"), ContentID: "logo"},
+		{Name: "statement.pdf", ContentType: "application/pdf", Content: pdf},
+	}}, "Statement", `<img src="cid:logo">`, "statement", "<id@ditto.trade>", time.Now())
+	require.NoError(t, err)
+
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(msg)))
+	h, err := r.ReadMIMEHeader()
+	require.NoError(t, err)
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/mixed", mediaType)
+
+	mr := multipart.NewReader(r.R, params["boundary"])
+	related, err := mr.NextPart()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(related.Header.Get("Content-Type"), "multipart/related"))
+	attached, err := mr.NextPart()
+	require.NoError(t, err)
+	require.Equal(t, "statement.pdf", attached.FileName())
+	content, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, attached))
+	require.NoError(t, err)
+	require.Equal(t, pdf, content)
+	_, err = mr.NextPart()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestBuildMessage_AttachmentContentType(t *testing.T) {
+	msg, err := buildMessage(Email{From: "a@ditto.trade", To: "b@ditto.trade", Attachments: []Attachment{
+		{Name: "выписка.csv", ContentType: "text/csv; charset=utf-8", Content: []byte("a,b")},
+	}}, "Statement", "", "statement", "<id@ditto.trade>", time.Now())
+	require.NoError(t, err)
+
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(msg)))
+	h, err := r.ReadMIMEHeader()
+	require.NoError(t, err)
+	_, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	require.NoError(t, err)
+	mr := multipart.NewReader(r.R, params["boundary"])
+	_, err = mr.NextPart()
+	require.NoError(t, err)
+	attached, err := mr.NextPart()
+	require.NoError(t, err)
+	mediaType, params, err := mime.ParseMediaType(attached.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "text/csv", mediaType)
+	require.Equal(t, "utf-8", params["charset"])
+	require.Equal(t, "выписка.csv", params["name"])
+	require.Equal(t, "выписка.csv", attached.FileName())
+
+	_, err = buildMessage(Email{From: "a@ditto.trade", To: "b@ditto.trade", Attachments: []Attachment{
+		{Name: "statement.csv", ContentType: "text csv", Content: []byte("a,b")},
+	}}, "Statement", "", "statement", "<id@ditto.trade>", time.Now())
+	require.Error(t, err)
+}
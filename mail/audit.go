@@ -0,0 +1,249 @@
+package mail
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dittotrade/internal/db"
+	"github.com/dittotrade/internal/utils"
+)
+
+// AuditSchema creates table used by PostgresAuditLog
+const AuditSchema = `
+create table if not exists mail_audit (
+	id             bigserial primary key,
+	template       text not null,
+	tag            text not null default '',
+	recipient_hash text not null,
+	user_id        text not null default '',
+	message_id     text not null default '',
+	status         text not null,
+	error          text not null default '',
+	details        text not null default '',
+	attempted_at   timestamptz not null default now(),
+	submitted_at   timestamptz,
+	delivered_at   timestamptz,
+	opened_at      timestamptz,
+	bounced_at     timestamptz
+);
+create index if not exists mail_audit_recipient_idx on mail_audit (recipient_hash, attempted_at);
+create index if not exists mail_audit_user_idx on mail_audit (user_id, attempted_at) where user_id <> '';
+create index if not exists mail_audit_message_idx on mail_audit (message_id) where message_id <> '';
+`
+
+// Audit statuses, submitted, failed, refused, dropped and duplicate are set by Service, others by WebhookHandler
+const (
+	AuditStatusSubmitted = "submitted"
+	AuditStatusFailed    = "failed"
+	// AuditStatusRefused email did not reach transport: recipient is invalid, suppressed or opted out,
+	// rate limit is exceeded, model is invalid or send is cancelled
+	AuditStatusRefused = "refused"
+	// AuditStatusDropped email is dropped by sandbox
+	AuditStatusDropped = "dropped"
+	// AuditStatusDuplicate email is not sent again, MessageID is of the original email
+	AuditStatusDuplicate = "duplicate"
+
+	AuditStatusDelivered     = "delivered"
+	AuditStatusOpened        = "opened"
+	AuditStatusBounced       = "bounced"
+	AuditStatusSpamComplaint = "spam_complaint"
+)
+
+type (
+	// AuditEntry is a send attempt with its delivery lifecycle
+	AuditEntry struct {
+		ID       int64
+		Template string
+		Tag      string
+		// RecipientHash is HashRecipient of the recipient, addresses are not stored
+		RecipientHash string
+		// UserID is user_id of Email.Metadata
+		UserID      string
+		MessageID   string
+		Status      string
+		Error       string
+		Details     string
+		AttemptedAt time.Time
+		SubmittedAt time.Time
+		DeliveredAt time.Time
+		OpenedAt    time.Time
+		BouncedAt   time.Time
+	}
+
+	// AuditLog records send attempts
+	AuditLog interface {
+		Record(ctx context.Context, entry AuditEntry) error
+	}
+
+	// DeliveryTracker updates status of sent email by provider events
+	DeliveryTracker interface {
+		UpdateStatus(ctx context.Context, messageID, status string, at time.Time, details string) error
+	}
+
+	// PostgresAuditLog is AuditLog and DeliveryTracker in mail_audit table
+	PostgresAuditLog struct {
+		dbtx db.DBTX
+	}
+)
+
+// HashRecipient returns hash of email address stored in the audit log
+func HashRecipient(email string) string {
+	sum := sha256.Sum256([]byte(normalizeEmail(email)))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAuditTable creates mail_audit table if it does not exist
+func CreateAuditTable(ctx context.Context, dbtx db.DBTX) error {
+	if _, err := dbtx.ExecContext(ctx, AuditSchema); err != nil {
+		return fmt.Errorf("could not create mail_audit: %w", err)
+	}
+	return nil
+}
+
+// NewPostgresAuditLog creates AuditLog in Postgres
+func NewPostgresAuditLog(dbtx db.DBTX) *PostgresAuditLog {
+	return &PostgresAuditLog{dbtx: dbtx}
+}
+
+// Record inserts send attempt
+func (l *PostgresAuditLog) Record(ctx context.Context, e AuditEntry) error {
+	if e.AttemptedAt.IsZero() {
+		e.AttemptedAt = time.Now()
+	}
+	if _, err := l.dbtx.ExecContext(ctx, `INSERT INTO mail_audit(template, tag, recipient_hash, user_id, message_id,
+		status, error, attempted_at, submitted_at) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)`,
+		e.Template, e.Tag, e.RecipientHash, e.UserID, e.MessageID, e.Status, e.Error, e.AttemptedAt,
+		nullTime(e.SubmittedAt)); err != nil {
+		return fmt.Errorf("could not record mail audit: %w", err)
+	}
+	return nil
+}
+
+// UpdateStatus sets status of email by MessageID.
+// Late delivery event does not override opened or bounced status.
+func (l *PostgresAuditLog) UpdateStatus(ctx context.Context, messageID, status string, at time.Time,
+	details string) error {
+	if _, err := l.dbtx.ExecContext(ctx, `UPDATE mail_audit SET
+		status = CASE WHEN $2 = 'delivered' AND status IN ('opened', 'bounced', 'spam_complaint') THEN status
+			ELSE $2 END,
+		details = CASE WHEN $4 = '' THEN details ELSE $4 END,
+		delivered_at = CASE WHEN $2 = 'delivered' THEN $3 ELSE delivered_at END,
+		opened_at = CASE WHEN $2 = 'opened' THEN coalesce(opened_at, $3) ELSE opened_at END,
+		bounced_at = CASE WHEN $2 IN ('bounced', 'spam_complaint') THEN $3 ELSE bounced_at END
+		WHERE message_id = $1`, messageID, status, at, details); err != nil {
+		return fmt.Errorf("could not update mail audit of %s: %w", messageID, err)
+	}
+	return nil
+}
+
+// ByRecipient returns latest entries of emails sent to address
+func (l *PostgresAuditLog) ByRecipient(ctx context.Context, email string, limit int) ([]AuditEntry, error) {
+	return l.query(ctx, `recipient_hash = $1`, HashRecipient(email), limit)
+}
+
+// ByUser returns latest entries of emails with user_id metadata
+func (l *PostgresAuditLog) ByUser(ctx context.Context, userID string, limit int) ([]AuditEntry, error) {
+	return l.query(ctx, `user_id = $1`, userID, limit)
+}
+
+func (l *PostgresAuditLog) query(ctx context.Context, where string, arg interface{}, limit int) (
+	res []AuditEntry, err error) {
+	rows, err := l.dbtx.QueryContext(ctx, `SELECT id, template, tag, recipient_hash, user_id, message_id, status,
+		error, details, attempted_at, submitted_at, delivered_at, opened_at, bounced_at
+		FROM mail_audit WHERE `+where+` ORDER BY attempted_at DESC, id DESC LIMIT $2`, arg, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not query mail audit: %w", err)
+	}
+	defer utils.CloseOrErr(rows, &err)
+	for rows.Next() {
+		var e AuditEntry
+		var submitted, delivered, opened, bounced sql.NullTime
+		if err = rows.Scan(&e.ID, &e.Template, &e.Tag, &e.RecipientHash, &e.UserID, &e.MessageID, &e.Status,
+			&e.Error, &e.Details, &e.AttemptedAt, &submitted, &delivered, &opened, &bounced); err != nil {
+			return nil, err
+		}
+		e.SubmittedAt, e.DeliveredAt, e.OpenedAt, e.BouncedAt = submitted.Time, delivered.Time, opened.Time,
+			bounced.Time
+		res = append(res, e)
+	}
+	return res, rows.Err()
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// audit records result of transport attempt of prepared email, audit failures are logged and do not fail the send.
+// Entries are found by the original recipient even if sandbox rewrote it.
+func (s *Service) audit(p prepared, res Response, sendErr error) {
+	if s.auditLog == nil {
+		return
+	}
+	entry := AuditEntry{
+		Template:      p.email.TemplateAlias,
+		Tag:           p.email.Tag,
+		RecipientHash: HashRecipient(p.address),
+		UserID:        p.email.Metadata["user_id"],
+		Status:        AuditStatusSubmitted,
+		MessageID:     res.MessageID,
+		SubmittedAt:   res.SubmittedAt,
+	}
+	if sendErr != nil {
+		entry.Status, entry.Error = AuditStatusFailed, sendErr.Error()
+	}
+	s.recordAudit(entry)
+}
+
+// auditSkipped records email which did not reach transport with status
+// AuditStatusRefused, AuditStatusDropped or AuditStatusDuplicate
+func (s *Service) auditSkipped(tpl, tag, email string, data map[string]interface{}, o sendOptions, status string,
+	res Response, sendErr error) {
+	if s.auditLog == nil {
+		return
+	}
+	// invalid recipients are refused before they are parsed, their entries keep the raw value
+	address, err := recipientAddress(email)
+	if err != nil {
+		address = email
+	}
+	entry := AuditEntry{
+		Template:      s.localizedTemplate(tpl, s.resolveLocale(o.locale)),
+		Tag:           s.tag(tag),
+		RecipientHash: HashRecipient(address),
+		UserID:        metadata(data, o)["user_id"],
+		Status:        status,
+		MessageID:     res.MessageID,
+		SubmittedAt:   res.SubmittedAt,
+	}
+	if sendErr != nil {
+		entry.Error = sendErr.Error()
+	}
+	s.recordAudit(entry)
+}
+
+// auditPrepared records email which passed or failed prepare
+func (s *Service) auditPrepared(tpl, tag, email string, data map[string]interface{}, o sendOptions, p prepared,
+	err error) {
+	switch {
+	case err != nil:
+		s.auditSkipped(tpl, tag, email, data, o, AuditStatusRefused, Response{}, err)
+	case p.dropped:
+		s.auditSkipped(tpl, tag, email, data, o, AuditStatusDropped, p.res, nil)
+	case p.done:
+		s.auditSkipped(tpl, tag, email, data, o, AuditStatusDuplicate, p.res, nil)
+	}
+}
+
+func (s *Service) recordAudit(entry AuditEntry) {
+	// ctx of the send may be already expired, the attempt must be recorded anyway
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.auditLog.Record(ctx, entry); err != nil {
+		log.Printf("mail: %s", err)
+	}
+}
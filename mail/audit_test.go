@@ -0,0 +1,216 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryAudit is AuditLog and DeliveryTracker for tests without Postgres
+type memoryAudit struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+func (m *memoryAudit) Record(_ context.Context, e AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, e)
+	return nil
+}
+
+func (m *memoryAudit) UpdateStatus(_ context.Context, messageID, status string, at time.Time, details string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.entries {
+		if m.entries[i].MessageID == messageID {
+			m.entries[i].Status, m.entries[i].Details = status, details
+		}
+	}
+	return nil
+}
+
+func TestService_Audit(t *testing.T) {
+	audit := &memoryAudit{}
+	tr := &flakyTransport{errs: []error{&SendError{Kind: ErrTransient, Err: errors.New("503")}}}
+	cfg := testConfig
+	cfg.Retry = RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	s := New(tr, cfg, WithAuditLog(audit))
+	_, err := s.Send(context.TODO(), StopLossTmpl, stopLossTag, "Investor@ditto.trade",
+		StopLossModel{StrategyName: "Alpha", StrategyID: uuid.New()}, WithMetadata("user_id", "u1"))
+	require.NoError(t, err)
+
+	require.Len(t, audit.entries, 2)
+	failed, submitted := audit.entries[0], audit.entries[1]
+	require.Equal(t, AuditStatusFailed, failed.Status)
+	require.NotEmpty(t, failed.Error)
+	require.Equal(t, AuditStatusSubmitted, submitted.Status)
+	require.Equal(t, StopLossTmpl, submitted.Template)
+	require.Equal(t, stopLossTag, submitted.Tag)
+	require.Equal(t, HashRecipient("investor@ditto.trade"), submitted.RecipientHash)
+	require.Equal(t, "u1", submitted.UserID)
+	require.Empty(t, submitted.Error)
+}
+
+func TestService_AuditRecipient(t *testing.T) {
+	audit := &memoryAudit{}
+	outbox := NewOutbox()
+	cfg := testConfig
+	cfg.Sandbox = SandboxConfig{Mode: SandboxRewrite, Allowlist: []string{"ditto.trade"}, CatchAll: "qa@ditto.trade"}
+	s := New(outbox, cfg, WithAuditLog(audit))
+	ctx := context.TODO()
+
+	// entries are found by the bare address of the original recipient
+	for _, to := range []string{"Bob <Bob@ditto.trade>", "Investor <investor@example.com>"} {
+		_, err := s.Send(ctx, StopLossTmpl, stopLossTag, to, StopLossModel{StrategyName: "Alpha",
+			StrategyID: uuid.New()})
+		require.NoError(t, err)
+	}
+	_, err := s.Send(ctx, StopLossTmpl, stopLossTag, "Carol <carol@ditto.trade>", StopLossModel{StrategyName: "Alpha",
+		StrategyID: uuid.New()}, WithMetadata("user id", "u1"))
+	require.Error(t, err)
+
+	require.Len(t, audit.entries, 3)
+	require.Equal(t, HashRecipient("bob@ditto.trade"), audit.entries[0].RecipientHash)
+	require.Equal(t, "qa@ditto.trade", outbox.Emails()[1].To)
+	require.Equal(t, HashRecipient("investor@example.com"), audit.entries[1].RecipientHash)
+	require.Equal(t, AuditStatusRefused, audit.entries[2].Status)
+	require.Equal(t, HashRecipient("carol@ditto.trade"), audit.entries[2].RecipientHash)
+}
+
+func TestService_AuditRefused(t *testing.T) {
+	audit := &memoryAudit{}
+	suppressions := &memorySuppressions{}
+	preferences := &memoryPreferences{}
+	ctx := context.TODO()
+	require.NoError(t, suppressions.Suppress(ctx, Suppression{Email: "bounced@ditto.trade", Reason: "HardBounce"}))
+	require.NoError(t, preferences.SetOptedOut(ctx, "quiet@ditto.trade", CategoryTradingAlerts, true))
+	cfg := testConfig
+	cfg.RateLimits = map[string]RateLimit{VerificationCodeTmpl: {Max: 1, Window: time.Hour}}
+	cfg.Sandbox = SandboxConfig{Mode: SandboxDrop, Allowlist: []string{"ditto.trade"}}
+	outbox := NewOutbox()
+	s := New(outbox, cfg, WithAuditLog(audit), WithSuppressionList(suppressions), WithPreferences(preferences),
+		WithIdempotencyStore(&memoryIdempotency{}))
+	last := func() AuditEntry {
+		audit.mu.Lock()
+		defer audit.mu.Unlock()
+		return audit.entries[len(audit.entries)-1]
+	}
+
+	require.Error(t, s.SendNotificationStopLoss(ctx, "bounced@ditto.trade", "Alpha", uuid.New(), 900, 1000,
+		WithMetadata("user_id", "u1")))
+	require.Equal(t, AuditStatusRefused, last().Status)
+	require.Contains(t, last().Error, ErrSuppressed.Error())
+	require.Equal(t, "u1", last().UserID)
+	require.Equal(t, HashRecipient("bounced@ditto.trade"), last().RecipientHash)
+
+	require.Error(t, s.SendNotificationStopLoss(ctx, "quiet@ditto.trade", "Alpha", uuid.New(), 900, 1000))
+	require.Equal(t, AuditStatusRefused, last().Status)
+	require.Contains(t, last().Error, ErrOptedOut.Error())
+
+	require.NoError(t, s.SendVerificationCode(ctx, "user01@ditto.trade", "111111"))
+	require.Equal(t, AuditStatusSubmitted, last().Status)
+	require.Error(t, s.SendVerificationCode(ctx, "user01@ditto.trade", "111111"))
+	require.Equal(t, AuditStatusRefused, last().Status)
+	require.Contains(t, last().Error, ErrRateLimited.Error())
+
+	require.NoError(t, s.SendVerificationCode(ctx, "investor@example.com", "111111"))
+	require.Equal(t, AuditStatusDropped, last().Status)
+
+	transactionID := uuid.New()
+	require.NoError(t, s.SendDepositConfirmation(ctx, "investor@ditto.trade", transactionID, 100, "USD"))
+	original := last()
+	require.NoError(t, s.SendDepositConfirmation(ctx, "investor@ditto.trade", transactionID, 100, "USD"))
+	require.Equal(t, AuditStatusDuplicate, last().Status)
+	require.Equal(t, original.MessageID, last().MessageID)
+
+	require.ErrorIs(t, s.SendVerificationCode(ContextWithBrand(ctx, "unknown"), "user02@ditto.trade", "111111"),
+		ErrUnknownBrand)
+	require.Equal(t, AuditStatusRefused, last().Status)
+
+	_, err := s.Send(ctx, StopLossTmpl, stopLossTag, "investor@ditto.trade",
+		map[string]interface{}{"strategy_name": "Alpha"})
+	require.ErrorIs(t, err, ErrMissingTemplateVars)
+	require.Equal(t, AuditStatusRefused, last().Status)
+	require.Equal(t, StopLossTmpl, last().Template)
+	require.Equal(t, stopLossTag, last().Tag)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	require.ErrorIs(t, s.SendVerificationCode(cancelled, "user03@ditto.trade", "111111"), context.Canceled)
+	require.Equal(t, AuditStatusRefused, last().Status)
+	require.Len(t, audit.entries, 10)
+	require.Equal(t, 2, outbox.Len())
+}
+
+func TestWebhookHandler_DeliveryTracker(t *testing.T) {
+	audit := &memoryAudit{entries: []AuditEntry{{MessageID: "m1", Status: AuditStatusSubmitted}}}
+	h := NewWebhookHandler(nil, "postmark", "secret").WithDeliveryTracker(audit)
+	post := func(body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/webhooks/postmark", strings.NewReader(body))
+		r.SetBasicAuth("postmark", "secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusOK, post(`{"RecordType":"Delivery","MessageID":"m1","Recipient":"john@ditto.trade",
+		"DeliveredAt":"2019-11-05T16:33:54.9070259Z","Details":"Test delivery webhook details"}`))
+	require.Equal(t, AuditStatusDelivered, audit.entries[0].Status)
+	require.Equal(t, "Test delivery webhook details", audit.entries[0].Details)
+
+	require.Equal(t, http.StatusOK, post(`{"RecordType":"Open","MessageID":"m1","FirstOpen":true,
+		"ReceivedAt":"2019-11-05T16:35:54Z"}`))
+	require.Equal(t, AuditStatusOpened, audit.entries[0].Status)
+
+	require.Equal(t, http.StatusOK, post(`{"RecordType":"Bounce","Type":"HardBounce","MessageID":"m1",
+		"Email":"john@ditto.trade","Description":"Unknown user"}`))
+	require.Equal(t, AuditStatusBounced, audit.entries[0].Status)
+	require.Equal(t, "HardBounce: Unknown user", audit.entries[0].Details)
+}
+
+func TestPostgresAuditLog(t *testing.T) {
+	database := openTestDB(t)
+	ctx := context.TODO()
+	require.NoError(t, CreateAuditTable(ctx, database))
+	auditLog := NewPostgresAuditLog(database)
+	email := "audit-" + uuid.NewString() + "@ditto.trade"
+	userID := uuid.NewString()
+	defer func() {
+		_, _ = database.ExecContext(ctx, "DELETE FROM mail_audit WHERE recipient_hash = $1", HashRecipient(email))
+	}()
+
+	messageID := uuid.NewString()
+	require.NoError(t, auditLog.Record(ctx, AuditEntry{Template: StopLossTmpl, Tag: stopLossTag,
+		RecipientHash: HashRecipient(email), UserID: userID, Status: AuditStatusFailed, Error: "timeout"}))
+	require.NoError(t, auditLog.Record(ctx, AuditEntry{Template: StopLossTmpl, Tag: stopLossTag,
+		RecipientHash: HashRecipient(email), UserID: userID, Status: AuditStatusSubmitted, MessageID: messageID,
+		SubmittedAt: time.Now()}))
+
+	now := time.Now()
+	require.NoError(t, auditLog.UpdateStatus(ctx, messageID, AuditStatusOpened, now, ""))
+	// late delivery event keeps opened status
+	require.NoError(t, auditLog.UpdateStatus(ctx, messageID, AuditStatusDelivered, now.Add(-time.Second), "250 OK"))
+
+	entries, err := auditLog.ByRecipient(ctx, strings.ToUpper(email), 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, AuditStatusOpened, entries[0].Status)
+	require.Equal(t, "250 OK", entries[0].Details)
+	require.False(t, entries[0].DeliveredAt.IsZero())
+	require.False(t, entries[0].OpenedAt.IsZero())
+	require.Equal(t, "timeout", entries[1].Error)
+
+	entries, err = auditLog.ByUser(ctx, userID, 1)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, messageID, entries[0].MessageID)
+}
@@ -0,0 +1,159 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+)
+
+// PostmarkBatchLimit is the maximum number of emails in one Postmark batch request
+const PostmarkBatchLimit = 500
+
+type (
+	// BatchItem is a single email of SendBatch
+	BatchItem struct {
+		Template string
+		Tag      string
+		To       string
+		// Locale of recipient, see WithLocale
+		Locale string
+		// Model is a struct or map as in Service.Send
+		Model interface{}
+	}
+
+	// BatchResult is outcome of email with the same index in the batch
+	BatchResult struct {
+		Response
+		Err error
+	}
+
+	// BatchTransport is Transport which sends many emails in one request.
+	// Failure of an email (including failure of the whole request) is reported in its BatchResult,
+	// error is returned only for invalid batch.
+	BatchTransport interface {
+		Transport
+		SendBatch(ctx context.Context, emails []Email) ([]BatchResult, error)
+	}
+)
+
+// SendBatch sends items in chunks of PostmarkBatchLimit and returns results in order of items.
+// Transport without batch support sends emails one by one.
+// Every item passes the same checks as Send* methods, transient failures are retried
+// and critical items fail over to fallback transports.
+// WithAttachments attaches the same files to every email.
+// WithIdempotencyKey and WithResponse are ignored, default idempotency keys still apply.
+// Returned error reports the number of failed items and the first error.
+func (s *Service) SendBatch(ctx context.Context, items []BatchItem, opts ...SendOption) ([]BatchResult, error) {
+	o := s.sendOptions(opts)
+	o.idempotencyKey, o.response = "", nil
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+
+	var err error
+	if o.attachments, err = readAttachments(o.attachments, s.maxAttachmentsSize()); err != nil {
+		err = fmt.Errorf("could not send emails: %w", err)
+		for _, item := range items {
+			s.auditSkipped(item.Template, item.Tag, item.To, nil, o, AuditStatusRefused, Response{}, err)
+		}
+		return nil, err
+	}
+
+	results := make([]BatchResult, len(items))
+	preps := make([]prepared, len(items))
+	var pending []int
+	for i, item := range items {
+		itemOpts := o
+		if item.Locale != "" {
+			itemOpts.locale = item.Locale
+		}
+		data, err := templateModel(item.Model)
+		if err != nil {
+			results[i].Err = fmt.Errorf("could not send email: %w", err)
+			s.auditSkipped(item.Template, item.Tag, item.To, nil, itemOpts, AuditStatusRefused, Response{},
+				results[i].Err)
+			continue
+		}
+		p, err := s.prepare(ctx, item.Template, item.Tag, item.To, data, itemOpts)
+		s.auditPrepared(item.Template, item.Tag, item.To, data, itemOpts, p, err)
+		switch {
+		case err != nil:
+			results[i].Err = err
+		case p.done:
+			results[i].Response = p.res
+		default:
+			preps[i] = p
+			pending = append(pending, i)
+		}
+	}
+
+	for start := 0; start < len(pending); start += PostmarkBatchLimit {
+		end := start + PostmarkBatchLimit
+		if end > len(pending) {
+			end = len(pending)
+		}
+		s.sendChunk(ctx, pending[start:end], preps, results)
+	}
+	for _, i := range pending {
+		s.finish(preps[i], results[i].Response, results[i].Err)
+		if results[i].Err != nil {
+			results[i].Err = fmt.Errorf("could not send email: %w", wrapContextError(ctx, results[i].Err))
+		}
+	}
+
+	var failed int
+	var firstErr error
+	for _, r := range results {
+		if r.Err != nil {
+			if failed == 0 {
+				firstErr = r.Err
+			}
+			failed++
+		}
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("could not send %d of %d emails: %w", failed, len(items), firstErr)
+	}
+	return results, nil
+}
+
+// sendChunk sends prepared emails of indices retrying those which failed transiently,
+// transport attempts are audited by deliverBatch
+func (s *Service) sendChunk(ctx context.Context, indices []int, preps []prepared, results []BatchResult) {
+	_ = s.retryPolicy().retry(ctx, func() error {
+		chunk := make([]prepared, len(indices))
+		for j, i := range indices {
+			chunk[j] = preps[i]
+		}
+		res := s.deliverBatch(ctx, chunk)
+		var retry []int
+		var retryErr error
+		for j, i := range indices {
+			results[i] = res[j]
+			if res[j].Err != nil && IsRetryable(res[j].Err) {
+				retry = append(retry, i)
+				retryErr = res[j].Err
+			}
+		}
+		indices = retry
+		return retryErr
+	})
+}
+
+// sendBatch uses BatchTransport if possible
+func sendBatch(ctx context.Context, t Transport, emails []Email) ([]BatchResult, error) {
+	if bt, ok := t.(BatchTransport); ok {
+		return bt.SendBatch(ctx, emails)
+	}
+	return sendEach(ctx, t, emails), nil
+}
+
+// sendEach sends emails one by one, it implements SendBatch of transports without batch API
+func sendEach(ctx context.Context, t Transport, emails []Email) []BatchResult {
+	results := make([]BatchResult, len(emails))
+	for i, email := range emails {
+		results[i].Response, results[i].Err = t.Send(ctx, email)
+	}
+	return results
+}
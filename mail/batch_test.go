@@ -0,0 +1,105 @@
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/keighl/postmark"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostmarkTransport_SendBatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/email/batchWithTemplates", r.URL.Path)
+		var batch struct{ Messages []postmark.TemplatedEmail }
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&batch))
+		res := make([]postmark.EmailResponse, len(batch.Messages))
+		for i, m := range batch.Messages {
+			res[i] = postmark.EmailResponse{To: m.To, MessageID: "id-" + m.To}
+			if m.To == "inactive@ditto.trade" {
+				res[i] = postmark.EmailResponse{ErrorCode: 406, Message: "inactive"}
+			}
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	}))
+	defer srv.Close()
+	tr := NewPostmarkTransport("server-token", "account-token")
+	tr.client.BaseURL = srv.URL
+
+	res, err := tr.SendBatch(context.TODO(), []Email{
+		{TemplateAlias: StopLossTmpl, To: "a@ditto.trade"},
+		{TemplateAlias: StopLossTmpl, To: "inactive@ditto.trade"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "id-a@ditto.trade", res[0].MessageID)
+	require.ErrorIs(t, res[1].Err, ErrInactiveRecipient)
+
+	_, err = tr.SendBatch(context.TODO(), make([]Email, PostmarkBatchLimit+1))
+	require.Error(t, err)
+}
+
+// batchCounter records sizes of batches and fails the first attempt of some recipients transiently
+type batchCounter struct {
+	*Outbox
+	mu      sync.Mutex
+	batches []int
+	failed  map[string]bool
+}
+
+func (b *batchCounter) SendBatch(ctx context.Context, emails []Email) ([]BatchResult, error) {
+	b.mu.Lock()
+	b.batches = append(b.batches, len(emails))
+	b.mu.Unlock()
+	res, err := b.Outbox.SendBatch(ctx, emails)
+	for i, e := range emails {
+		if e.To == "flaky@ditto.trade" && !b.failed[e.To] {
+			b.failed[e.To] = true
+			res[i] = BatchResult{Err: &SendError{Kind: ErrTransient, Err: fmt.Errorf("timeout")}}
+		}
+	}
+	return res, err
+}
+
+func TestService_SendBatch(t *testing.T) {
+	tr := &batchCounter{Outbox: NewOutbox(), failed: make(map[string]bool)}
+	cfg := testConfig
+	cfg.Retry = RetryPolicy{MaxAttempts: 2}
+	suppressions := &memorySuppressions{}
+	require.NoError(t, suppressions.Suppress(context.TODO(), Suppression{Email: "bounced@ditto.trade"}))
+	audit := &memoryAudit{}
+	s := New(tr, cfg, WithSuppressionList(suppressions), WithAuditLog(audit))
+	strategyID := uuid.New()
+
+	items := make([]BatchItem, 0, 1001)
+	for i := 0; i < 999; i++ {
+		items = append(items, BatchItem{Template: StopLossTmpl, Tag: "investment_stop_loss",
+			To: fmt.Sprintf("investor%d@ditto.trade", i), Model: StopLossModel{StrategyName: "Alpha", StrategyID: strategyID, Equity: 900, StopLoss: 1000}})
+	}
+	items = append(items,
+		BatchItem{Template: StopLossTmpl, To: "flaky@ditto.trade", Model: StopLossModel{StrategyName: "Alpha", StrategyID: strategyID, Equity: 900, StopLoss: 1000}},
+		BatchItem{Template: StopLossTmpl, To: "bounced@ditto.trade", Locale: "de"})
+
+	res, err := s.SendBatch(context.TODO(), items)
+	require.ErrorIs(t, err, ErrSuppressed)
+	require.ErrorIs(t, res[1000].Err, ErrSuppressed)
+	require.Len(t, res, len(items))
+	require.Equal(t, []int{500, 500, 1}, tr.batches, "flaky recipient is retried alone")
+	require.NotEmpty(t, res[0].MessageID)
+	require.NoError(t, res[999].Err)
+	require.Equal(t, 1001, tr.Len(), "outbox captures the failed attempt too")
+	email, ok := tr.AssertSent(t, StopLossTmpl, "investor0@ditto.trade")
+	require.True(t, ok)
+	require.Equal(t, "Ditto Trade", email.TemplateModel["product_name"])
+
+	statuses := make(map[string]int)
+	for _, e := range audit.entries {
+		statuses[e.Status]++
+	}
+	require.Equal(t, map[string]int{AuditStatusSubmitted: 1000, AuditStatusFailed: 1, AuditStatusRefused: 1}, statuses)
+}
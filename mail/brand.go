@@ -0,0 +1,109 @@
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrUnknownBrand is returned when brand selected by WithBrand or ContextWithBrand is not in Config.Brands
+var ErrUnknownBrand = errors.New("unknown brand")
+
+// Brand overrides product details and addresses of Config for partner-branded (white-label) emails.
+// Empty fields keep Config values.
+type Brand struct {
+	ProductName    string
+	ProductURL     string
+	SupportURL     string
+	SupportEmail   string
+	CompanyName    string
+	CompanyAddress string
+	FromEmail      string
+	FromName       string
+	// Locales overrides brand details for recipients of a locale,
+	// Config.Locales overrides apply to the default brand only
+	Locales map[string]LocaleConfig
+}
+
+type brandKey struct{}
+
+// ContextWithBrand returns ctx which selects brand of emails sent with it, WithBrand takes precedence
+func ContextWithBrand(ctx context.Context, brand string) context.Context {
+	return context.WithValue(ctx, brandKey{}, brand)
+}
+
+// BrandFromContext returns brand set by ContextWithBrand or empty string for the default brand
+func BrandFromContext(ctx context.Context) string {
+	brand, _ := ctx.Value(brandKey{}).(string)
+	return brand
+}
+
+// WithBrand selects brand of email from Config.Brands, empty brand is the default one
+func WithBrand(brand string) SendOption {
+	return func(o *sendOptions) {
+		o.brand = brand
+	}
+}
+
+// resolveBrand sets brand of options from ctx unless it is given by WithBrand
+func (s *Service) resolveBrand(ctx context.Context, o *sendOptions) error {
+	if o.brand == "" {
+		o.brand = BrandFromContext(ctx)
+	}
+	if o.brand == "" {
+		return nil
+	}
+	if _, ok := s.config.Brands[o.brand]; !ok {
+		return fmt.Errorf("%w %q", ErrUnknownBrand, o.brand)
+	}
+	return nil
+}
+
+// brandConfig returns Config with overrides of brand applied
+func (s *Service) brandConfig(brand string) Config {
+	cfg := s.config
+	b, ok := cfg.Brands[brand]
+	if brand == "" || !ok {
+		return cfg
+	}
+	for _, o := range []struct {
+		dst *string
+		v   string
+	}{
+		{&cfg.ProductName, b.ProductName},
+		{&cfg.ProductURL, b.ProductURL},
+		{&cfg.SupportURL, b.SupportURL},
+		{&cfg.SupportEmail, b.SupportEmail},
+		{&cfg.CompanyName, b.CompanyName},
+		{&cfg.CompanyAddress, b.CompanyAddress},
+		{&cfg.FromEmail, b.FromEmail},
+		{&cfg.FromName, b.FromName},
+	} {
+		if o.v != "" {
+			*o.dst = o.v
+		}
+	}
+	cfg.Locales = b.Locales
+	return cfg
+}
+
+// envBrands reads Config.Brands from JSON file named by ENV key, e.g. {"partner": {"ProductName": "Partner"}}
+func envBrands(errs *configErrors, key string) map[string]Brand {
+	path := os.Getenv(key)
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		errs.add("ENV %s: %s", key, err)
+		return nil
+	}
+	var brands map[string]Brand
+	if err = json.Unmarshal(data, &brands); err != nil {
+		errs.add("ENV %s: malformed brands file: %s", key, err)
+		return nil
+	}
+	return brands
+}
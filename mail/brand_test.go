@@ -0,0 +1,94 @@
+package mail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+var testBrands = map[string]Brand{
+	"partner": {
+		ProductName:  "Partner Invest",
+		ProductURL:   "https://invest.partner.example",
+		SupportEmail: "help@partner.example",
+		FromEmail:    "no-reply@partner.example",
+		FromName:     "Partner Invest",
+		Locales:      map[string]LocaleConfig{"de": {ProductName: "Partner Anlage"}},
+	},
+}
+
+func TestService_Brand(t *testing.T) {
+	outbox := NewOutbox()
+	cfg := testConfig
+	cfg.Brands = testBrands
+	cfg.Locales = map[string]LocaleConfig{"de": {ProductName: "Ditto Handel"}}
+	s := New(outbox, cfg)
+
+	require.NoError(t, s.SendVerificationCode(context.TODO(), "default@ditto.trade", "111111"))
+	email := outbox.SentTo("default@ditto.trade")[0]
+	require.Equal(t, `"Ditto Trade" <notifications@ditto.trade>`, email.From)
+	require.Equal(t, "Ditto Trade", email.TemplateModel["product_name"])
+	require.Empty(t, email.Metadata["brand"])
+
+	require.NoError(t, s.SendVerificationCode(context.TODO(), "option@ditto.trade", "111111", WithBrand("partner")))
+	email = outbox.SentTo("option@ditto.trade")[0]
+	require.Equal(t, `"Partner Invest" <no-reply@partner.example>`, email.From)
+	require.Equal(t, "help@partner.example", email.ReplyTo)
+	require.Equal(t, "Partner Invest", email.TemplateModel["product_name"])
+	require.Equal(t, "https://invest.partner.example", email.TemplateModel["product_url"])
+	// unset fields are inherited
+	require.Equal(t, testConfig.CompanyAddress, email.TemplateModel["company_address"])
+	require.Equal(t, "partner", email.Metadata["brand"])
+
+	ctx := ContextWithBrand(context.TODO(), "partner")
+	require.NoError(t, s.SendNotificationStopLoss(ctx, "context@ditto.trade", "Alpha", uuid.New(), 900, 1000,
+		WithLocale("de")))
+	email = outbox.SentTo("context@ditto.trade")[0]
+	require.Equal(t, `"Partner Invest" <no-reply@partner.example>`, email.From)
+	require.Equal(t, "Partner Anlage", email.TemplateModel["product_name"])
+
+	unknown := ContextWithBrand(context.TODO(), "unknown")
+	err := s.SendVerificationCode(unknown, "unknown@ditto.trade", "111111")
+	require.ErrorIs(t, err, ErrUnknownBrand)
+	require.Empty(t, outbox.SentTo("unknown@ditto.trade"))
+
+	// option takes precedence over context
+	require.NoError(t, s.SendVerificationCode(unknown, "unknown@ditto.trade", "111111", WithBrand("partner")))
+	require.Equal(t, `"Partner Invest" <no-reply@partner.example>`,
+		outbox.SentTo("unknown@ditto.trade")[0].From)
+}
+
+func TestConfig_ValidateBrands(t *testing.T) {
+	cfg := testConfig
+	cfg.Brands = map[string]Brand{
+		"":        {},
+		"partner": {FromEmail: "partner", ProductURL: "invest.partner.example"},
+	}
+	err := cfg.Validate()
+	require.ErrorIs(t, err, ErrInvalidConfig)
+	require.Contains(t, err.Error(), "Brands must not have empty ID")
+	require.Contains(t, err.Error(), `Brands[partner].FromEmail "partner"`)
+	require.Contains(t, err.Error(), `Brands[partner].ProductURL "invest.partner.example"`)
+
+	cfg.Brands = testBrands
+	require.NoError(t, cfg.Validate())
+}
+
+func TestEnvBrands(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "brands.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"partner": {"ProductName": "Partner Invest",
+		"FromEmail": "no-reply@partner.example"}}`), 0o600))
+	t.Setenv("MAIL_BRANDS_FILE", path)
+	var errs configErrors
+	brands := envBrands(&errs, "MAIL_BRANDS_FILE")
+	require.Empty(t, errs)
+	require.Equal(t, "Partner Invest", brands["partner"].ProductName)
+
+	require.NoError(t, os.WriteFile(path, []byte(`[]`), 0o600))
+	require.Nil(t, envBrands(&errs, "MAIL_BRANDS_FILE"))
+	require.Len(t, errs, 1)
+}
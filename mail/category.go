@@ -0,0 +1,82 @@
+package mail
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Template categories, they select Postmark message stream
+const (
+	// CategorySecurity are OTP codes and confirmations of money movements
+	CategorySecurity = "security"
+	// CategoryTradingAlerts are notifications about investments and copied strategies
+	CategoryTradingAlerts = "trading_alerts"
+	// CategoryReports are statements and digests
+	CategoryReports = "reports"
+	// CategoryMarketing are broadcast emails
+	CategoryMarketing = "marketing"
+)
+
+// templateCategories of predefined templates, see WithTemplateCategory for others
+var templateCategories = map[string]string{
+	VerificationCodeTmpl:   CategorySecurity,
+	PasswordResetTmpl:      CategorySecurity,
+	DestroyAccountCodeTmpl: CategorySecurity,
+	DepositTmpl:            CategorySecurity,
+	WithdrawalTmpl:         CategorySecurity,
+	StopLossTmpl:           CategoryTradingAlerts,
+	StopLossDigestTmpl:     CategoryTradingAlerts,
+	TakeProfitTmpl:         CategoryTradingAlerts,
+	MarginCallTmpl:         CategoryTradingAlerts,
+	DrawdownTmpl:           CategoryTradingAlerts,
+	CopyStartedTmpl:        CategoryTradingAlerts,
+	CopyStoppedTmpl:        CategoryTradingAlerts,
+	StrategyPausedTmpl:     CategoryTradingAlerts,
+}
+
+// metadataFields are model variables copied into Email.Metadata
+var metadataFields = []string{"user_id", "strategy_id", "investment_account_id"}
+
+// category returns category of template or empty string if it is unknown
+func (s *Service) category(tpl string) string {
+	if c, ok := s.categories[tpl]; ok {
+		return c
+	}
+	return templateCategories[tpl]
+}
+
+// messageStream returns Postmark message stream of template category
+func (s *Service) messageStream(tpl string) string {
+	return s.streams[s.category(tpl)]
+}
+
+// metadata merges metadataFields of model with WithMetadata values
+func metadata(data map[string]interface{}, o sendOptions) map[string]string {
+	res := make(map[string]string, len(o.metadata))
+	for _, f := range metadataFields {
+		if v, ok := data[f]; ok {
+			res[f] = fmt.Sprint(v)
+		}
+	}
+	if o.brand != "" {
+		res["brand"] = o.brand
+	}
+	for k, v := range o.metadata {
+		res[k] = v
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
+
+// checkMetadata rejects keys which cannot be a name of X-Metadata-<key> header of SMTP message:
+// empty ones and ones with ':', spaces or control characters
+func checkMetadata(md map[string]string) error {
+	for k := range md {
+		if k == "" || strings.IndexFunc(k, func(r rune) bool { return r <= ' ' || r > '~' || r == ':' }) >= 0 {
+			return fmt.Errorf("invalid metadata key %q", k)
+		}
+	}
+	return nil
+}
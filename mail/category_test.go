@@ -0,0 +1,48 @@
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_MessageStreamAndMetadata(t *testing.T) {
+	var got map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = nil
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		_ = json.NewEncoder(w).Encode(map[string]string{"MessageID": "message-id"})
+	}))
+	defer srv.Close()
+	tr := NewPostmarkTransport("server-token", "account-token")
+	tr.client.BaseURL = srv.URL
+	s := New(tr, testConfig,
+		WithCategoryStream(CategoryTradingAlerts, "alerts"),
+		WithCategoryStream(CategoryReports, "broadcast"),
+		WithTemplateCategory("monthly_statement", CategoryReports))
+	ctx := context.TODO()
+	strategyID := uuid.New()
+
+	require.NoError(t, s.SendNotificationStopLoss(ctx, "investor@ditto.trade", "Alpha", strategyID, 900, 1000,
+		WithMetadata("user_id", "42")))
+	require.Equal(t, "alerts", got["MessageStream"])
+	require.Equal(t, map[string]interface{}{"user_id": "42", "strategy_id": strategyID.String()}, got["Metadata"])
+
+	_, err := s.Send(ctx, "monthly_statement", "statement", "investor@ditto.trade", nil)
+	require.NoError(t, err)
+	require.Equal(t, "broadcast", got["MessageStream"])
+	require.NotContains(t, got, "Metadata")
+
+	require.NoError(t, s.SendVerificationCode(ctx, "investor@ditto.trade", "111111"))
+	require.NotContains(t, got, "MessageStream", "default stream")
+
+	got = nil
+	require.Error(t, s.SendVerificationCode(ctx, "investor@ditto.trade", "111111",
+		WithMetadata("user_id\r\nBcc", "x@evil.com")))
+	require.Nil(t, got)
+}
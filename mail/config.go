@@ -0,0 +1,298 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	netmail "net/mail"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dmitrymomot/go-env"
+)
+
+// Transports which may be selected by Config.Transport
+const (
+	TransportPostmark = "postmark"
+	TransportSMTP     = "smtp"
+	TransportFile     = "file"
+)
+
+// Template modes which may be selected by Config.TemplateMode
+const (
+	TemplatesLocal    = "local"
+	TemplatesPostmark = "postmark"
+)
+
+// ErrInvalidConfig is returned by Config.Validate, NewService and LoadConfigFromEnv
+var ErrInvalidConfig = errors.New("invalid mail config")
+
+// configErrors collects config problems to report all of them at once
+type configErrors []string
+
+func (e *configErrors) add(format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf(format, args...))
+}
+
+func (e configErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrInvalidConfig, strings.Join(e, "; "))
+}
+
+// checkAddresses adds errors of malformed FromEmail and SupportEmail, empty ones are skipped
+func (e *configErrors) checkAddresses(prefix, fromEmail, supportEmail string) {
+	for _, a := range []struct{ name, value string }{
+		{"FromEmail", fromEmail},
+		{"SupportEmail", supportEmail},
+	} {
+		if a.value == "" {
+			continue
+		}
+		if _, err := netmail.ParseAddress(a.value); err != nil {
+			e.add("%s%s %q: %s", prefix, a.name, a.value, err)
+		}
+	}
+}
+
+// checkURLs adds errors of ProductURL and SupportURL which are not absolute, empty ones are skipped
+func (e *configErrors) checkURLs(prefix, productURL, supportURL string) {
+	for _, u := range []struct{ name, value string }{
+		{"ProductURL", productURL},
+		{"SupportURL", supportURL},
+	} {
+		if u.value == "" {
+			continue
+		}
+		if parsed, err := url.Parse(u.value); err != nil || parsed.Host == "" ||
+			(parsed.Scheme != "http" && parsed.Scheme != "https") {
+			e.add("%s%s %q is not an absolute http(s) URL", prefix, u.name, u.value)
+		}
+	}
+}
+
+// Validate checks that config is complete and well-formed.
+// Transport settings are checked by NewService only when transport is built from Config.
+func (c Config) Validate() error {
+	var errs configErrors
+	if c.FromEmail == "" {
+		errs.add("FromEmail is required")
+	}
+	errs.checkAddresses("", c.FromEmail, c.SupportEmail)
+	errs.checkURLs("", c.ProductURL, c.SupportURL)
+	if c.UnsubscribeURL != "" {
+		if parsed, err := url.Parse(c.UnsubscribeURL); err != nil || parsed.Host == "" || parsed.RawQuery != "" {
+			errs.add("UnsubscribeURL %q is not an absolute URL without query", c.UnsubscribeURL)
+		}
+		if c.UnsubscribeSecret == "" {
+			errs.add("UnsubscribeSecret is required with UnsubscribeURL")
+		}
+	}
+	brands := make([]string, 0, len(c.Brands))
+	for id := range c.Brands {
+		brands = append(brands, id)
+	}
+	sort.Strings(brands)
+	for _, id := range brands {
+		if id == "" {
+			errs.add("Brands must not have empty ID")
+			continue
+		}
+		b := c.Brands[id]
+		errs.checkAddresses("Brands["+id+"].", b.FromEmail, b.SupportEmail)
+		errs.checkURLs("Brands["+id+"].", b.ProductURL, b.SupportURL)
+	}
+	if c.Timeout < 0 {
+		errs.add("Timeout must not be negative")
+	}
+	if c.Retry.MaxAttempts < 0 || c.Retry.InitialBackoff < 0 || c.Retry.MaxBackoff < 0 {
+		errs.add("Retry must not be negative")
+	}
+	if c.Breaker.Threshold < 0 || c.Breaker.Cooldown < 0 {
+		errs.add("Breaker must not be negative")
+	}
+	if c.DigestWindow < 0 {
+		errs.add("DigestWindow must not be negative")
+	}
+	for tpl, l := range c.RateLimits {
+		if l.Max < 0 || l.Window < 0 {
+			errs.add("RateLimits of %s must not be negative", tpl)
+		}
+	}
+	switch c.Sandbox.Mode {
+	case SandboxOff, SandboxDrop, SandboxLog:
+	case SandboxRewrite:
+		if _, err := netmail.ParseAddress(c.Sandbox.CatchAll); err != nil {
+			errs.add("Sandbox.CatchAll %q is required for %s mode: %s", c.Sandbox.CatchAll, SandboxRewrite, err)
+		}
+	default:
+		errs.add("unknown Sandbox.Mode %q", c.Sandbox.Mode)
+	}
+	switch c.TemplateMode {
+	case "", TemplatesLocal, TemplatesPostmark:
+	default:
+		errs.add("unknown TemplateMode %q", c.TemplateMode)
+	}
+	return errs.err()
+}
+
+// validateTransport checks settings of transport selected by Config.Transport
+func (c Config) validateTransport() error {
+	var errs configErrors
+	switch c.transport() {
+	case TransportPostmark:
+		if c.PostmarkServerToken == "" {
+			errs.add("PostmarkServerToken is required for %s transport", TransportPostmark)
+		}
+	case TransportSMTP:
+		if c.SMTP.Host == "" {
+			errs.add("SMTP.Host is required for %s transport", TransportSMTP)
+		}
+	case TransportFile:
+		if c.OutboxDir == "" {
+			errs.add("OutboxDir is required for %s transport", TransportFile)
+		}
+	default:
+		errs.add("unknown Transport %q", c.Transport)
+	}
+	return errs.err()
+}
+
+func (c Config) transport() string {
+	if c.Transport == "" {
+		return TransportPostmark
+	}
+	return c.Transport
+}
+
+// templateMode returns TemplateMode or default mode for the transport
+func (c Config) templateMode() string {
+	if c.TemplateMode != "" {
+		return c.TemplateMode
+	}
+	if c.transport() == TransportPostmark {
+		return TemplatesPostmark
+	}
+	return TemplatesLocal
+}
+
+// LoadConfigFromEnv reads Config from environment variables.
+// MAIL_TRANSPORT selects delivery: "postmark" (default), "smtp" or "file".
+// MAIL_TEMPLATES selects "local" (embedded) or "postmark" templates,
+// it defaults to "postmark" for Postmark transport and to "local" otherwise.
+// MAIL_SANDBOX ("drop", "log" or "rewrite"), MAIL_ALLOWLIST and MAIL_CATCH_ALL configure Sandbox,
+// MAIL_ENVIRONMENT prefixes tags unless it is "production",
+// MAIL_DIGEST_WINDOW enables digests of stop loss notifications with WithDigestQueue.
+// MAIL_BRANDS_FILE is a JSON file of Config.Brands by brand ID.
+// MAIL_UNSUBSCRIBE_URL and MAIL_UNSUBSCRIBE_SECRET add unsubscribe links to optional emails.
+// It reports missing required and malformed variables instead of terminating the program.
+func LoadConfigFromEnv() (Config, error) {
+	var errs configErrors
+	cfg := Config{
+		// Product
+		ProductName:    env.GetString("PRODUCT_NAME", "Ditto Trade"),
+		ProductURL:     env.GetString("PRODUCT_URL", "https://ditto.trade"),
+		SupportURL:     env.GetString("SUPPORT_URL", "https://ditto.trade/support"),
+		SupportEmail:   env.GetString("SUPPORT_EMAIL", "support@ditto.trade"),
+		CompanyName:    env.GetString("COMPANY_NAME", "Ditto Trade Pty Limited"),
+		CompanyAddress: env.GetString("COMPANY_ADDRESS", "Level 27, 25 Bligh Street, Sydney NSW 2000"),
+		// Mailer
+		FromName:     env.GetString("NOTIFICATION_FROM_NAME", "Ditto Trade"),
+		FromEmail:    env.GetString("NOTIFICATION_FROM_EMAIL", "notifications@ditto.trade"),
+		Timeout:      envDuration(&errs, "MAIL_TIMEOUT", DefaultTimeout),
+		Retry:        DefaultRetryPolicy,
+		Transport:    env.GetString("MAIL_TRANSPORT", TransportPostmark),
+		TemplateMode: env.GetString("MAIL_TEMPLATES", ""),
+		// Locales
+		DefaultLocale: env.GetString("MAIL_DEFAULT_LOCALE", DefaultLocale),
+		Locales:       make(map[string]LocaleConfig),
+	}
+	cfg.Retry.MaxAttempts = envInt(&errs, "MAIL_RETRY_ATTEMPTS", cfg.Retry.MaxAttempts)
+	cfg.DigestWindow = envDuration(&errs, "MAIL_DIGEST_WINDOW", 0)
+	cfg.Brands = envBrands(&errs, "MAIL_BRANDS_FILE")
+	cfg.UnsubscribeURL = env.GetString("MAIL_UNSUBSCRIBE_URL", "")
+	cfg.UnsubscribeSecret = env.GetString("MAIL_UNSUBSCRIBE_SECRET", "")
+	// Sandbox
+	cfg.Environment = env.GetString("MAIL_ENVIRONMENT", "")
+	cfg.Sandbox = SandboxConfig{
+		Mode:      env.GetString("MAIL_SANDBOX", SandboxOff),
+		Allowlist: splitList(env.GetString("MAIL_ALLOWLIST", "")),
+		CatchAll:  env.GetString("MAIL_CATCH_ALL", ""),
+	}
+	for _, l := range splitList(env.GetString("MAIL_LOCALES", "")) {
+		cfg.Locales[normalizeLocale(l)] = LocaleConfig{}
+	}
+	// Transport
+	switch cfg.Transport {
+	case TransportPostmark:
+		cfg.PostmarkServerToken = envRequired(&errs, "POSTMARK_SERVER_TOKEN")
+		cfg.PostmarkAccountToken = env.GetString("POSTMARK_ACCOUNT_TOKEN", "")
+	case TransportSMTP:
+		cfg.SMTP = SMTPConfig{
+			Host:       envRequired(&errs, "SMTP_HOST"),
+			Port:       envInt(&errs, "SMTP_PORT", 587),
+			Username:   env.GetString("SMTP_USERNAME", ""),
+			Password:   env.GetString("SMTP_PASSWORD", ""),
+			RequireTLS: envBool(&errs, "SMTP_REQUIRE_TLS", true),
+		}
+	case TransportFile:
+		cfg.OutboxDir = env.GetString("MAIL_OUTBOX_DIR", "mail_outbox")
+	default:
+		errs.add("unknown MAIL_TRANSPORT %q", cfg.Transport)
+	}
+	if err := errs.err(); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.Validate()
+}
+
+func envRequired(errs *configErrors, key string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		errs.add("required ENV %s is not set", key)
+	}
+	return v
+}
+
+func envInt(errs *configErrors, key string, fallback int) int {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	res, err := strconv.Atoi(v)
+	if err != nil {
+		errs.add("ENV %s=%q is not an integer", key, v)
+		return fallback
+	}
+	return res
+}
+
+func envBool(errs *configErrors, key string, fallback bool) bool {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	res, err := strconv.ParseBool(v)
+	if err != nil {
+		errs.add("ENV %s=%q is not a boolean", key, v)
+		return fallback
+	}
+	return res
+}
+
+func envDuration(errs *configErrors, key string, fallback time.Duration) time.Duration {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	res, err := time.ParseDuration(v)
+	if err != nil {
+		errs.add("ENV %s=%q is not a duration", key, v)
+		return fallback
+	}
+	return res
+}
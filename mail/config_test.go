@@ -0,0 +1,75 @@
+package mail
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	require.NoError(t, testConfig.Validate())
+
+	cfg := testConfig
+	cfg.FromEmail = ""
+	cfg.SupportURL = "ditto.trade/support"
+	cfg.TemplateMode = "remote"
+	err := cfg.Validate()
+	require.ErrorIs(t, err, ErrInvalidConfig)
+	require.Contains(t, err.Error(), "FromEmail is required")
+	require.Contains(t, err.Error(), "SupportURL")
+	require.Contains(t, err.Error(), "unknown TemplateMode")
+
+	cfg = testConfig
+	cfg.SupportEmail = "support"
+	require.ErrorIs(t, cfg.Validate(), ErrInvalidConfig)
+}
+
+func TestNewService(t *testing.T) {
+	_, err := NewService(testConfig)
+	require.ErrorIs(t, err, ErrInvalidConfig, "postmark token is required")
+
+	outbox := NewOutbox()
+	s, err := NewService(testConfig, WithTransport(outbox))
+	require.NoError(t, err)
+	require.Equal(t, outbox, s.transport)
+	require.Nil(t, s.templates, "postmark templates by default")
+
+	cfg := testConfig
+	cfg.PostmarkServerToken = "server-token"
+	client := &http.Client{}
+	s, err = NewService(cfg, WithHTTPClient(client))
+	require.NoError(t, err)
+	require.Same(t, client, s.transport.(*PostmarkTransport).client.HTTPClient)
+
+	cfg = testConfig
+	cfg.Transport = TransportFile
+	cfg.OutboxDir = t.TempDir()
+	s, err = NewService(cfg)
+	require.NoError(t, err)
+	require.IsType(t, &FileOutbox{}, s.transport)
+	require.NotNil(t, s.templates)
+}
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	t.Setenv("MAIL_TRANSPORT", TransportPostmark)
+	t.Setenv("POSTMARK_SERVER_TOKEN", "")
+	t.Setenv("MAIL_TIMEOUT", "soon")
+	_, err := LoadConfigFromEnv()
+	require.ErrorIs(t, err, ErrInvalidConfig)
+	require.Contains(t, err.Error(), "POSTMARK_SERVER_TOKEN")
+	require.Contains(t, err.Error(), "MAIL_TIMEOUT")
+
+	t.Setenv("POSTMARK_SERVER_TOKEN", "server-token")
+	t.Setenv("MAIL_TIMEOUT", "10s")
+	cfg, err := LoadConfigFromEnv()
+	require.NoError(t, err)
+	require.Equal(t, "server-token", cfg.PostmarkServerToken)
+	require.Equal(t, TemplatesPostmark, cfg.templateMode())
+
+	t.Setenv("MAIL_TRANSPORT", TransportSMTP)
+	t.Setenv("SMTP_HOST", "")
+	_, err = LoadConfigFromEnv()
+	require.ErrorIs(t, err, ErrInvalidConfig)
+	require.Contains(t, err.Error(), "SMTP_HOST")
+}
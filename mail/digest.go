@@ -0,0 +1,109 @@
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StopLossDigestTmpl summarizes stop loss notifications buffered for Config.DigestWindow
+var StopLossDigestTmpl = "stop_loss_digest"
+
+const stopLossDigestTag = "investment_stop_loss_digest"
+
+// ErrDigestOption is returned when notification which would be buffered for a digest is sent
+// with WithResponse, WithAttachments or WithMetadata, use WithUrgent to send it immediately
+var ErrDigestOption = errors.New("option is not supported by digests")
+
+// StopLossDigestModel is the model of StopLossDigestTmpl.
+// Notifications are StopLossModel variables with locale formatted equity and stop loss.
+type StopLossDigestModel struct {
+	Notifications []map[string]interface{} `json:"notifications"`
+	Count         int                      `json:"count"`
+}
+
+// digests reports whether stop loss notification sent with o is buffered
+func (s *Service) digests(o sendOptions) bool {
+	return s.config.DigestWindow > 0 && s.digestQueue != nil && !o.urgent && !o.critical
+}
+
+// addToDigest checks notification as Send does and stores it in mail_queue to be sent by Dispatcher.
+// The first pending notification of a recipient is due after Config.DigestWindow, the following ones join it.
+// Notifications of different brands are not mixed.
+func (s *Service) addToDigest(ctx context.Context, email string, item StopLossModel, o sendOptions) (err error) {
+	if o.response != nil || len(o.attachments) > 0 || len(o.metadata) > 0 {
+		return ErrDigestOption
+	}
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+	data, err := templateModel(item)
+	if err != nil {
+		return err
+	}
+	if err = s.resolveBrand(ctx, &o); err != nil {
+		s.auditSkipped(StopLossTmpl, stopLossTag, email, data, o, AuditStatusRefused, Response{}, err)
+		return err
+	}
+	p, err := s.prepare(ctx, StopLossTmpl, stopLossTag, email, data, o)
+	s.auditPrepared(StopLossTmpl, stopLossTag, email, data, o, p, err)
+	if err != nil || p.done {
+		return err
+	}
+	// buffered notification completes idempotency key, its duplicates are not buffered again
+	defer func() { s.finish(p, Response{To: email, SubmittedAt: time.Now()}, err) }()
+
+	address, err := recipientAddress(email)
+	if err != nil {
+		return err
+	}
+	model, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("could not encode model: %w", err)
+	}
+	if _, err = s.digestQueue.ExecContext(ctx, `INSERT INTO mail_queue(template, tag, recipient, locale, brand,
+		model, digest, next_attempt_at) VALUES ($1,$2,$3,$4,$5,$6,$7,coalesce(
+			(SELECT min(next_attempt_at) FROM mail_queue WHERE digest = $7 AND status = 'pending' AND attempts = 0),
+			now() + $8::bigint * interval '1 millisecond'))`,
+		StopLossTmpl, stopLossTag, email, o.locale, o.brand, model, o.brand+"/"+normalizeEmail(address),
+		s.config.DigestWindow.Milliseconds()); err != nil {
+		return fmt.Errorf("could not store notification in mail_queue: %w", err)
+	}
+	return nil
+}
+
+// sendDigest sends notifications of a digest claimed by Dispatcher,
+// a single notification is sent as StopLossTmpl
+func (s *Service) sendDigest(ctx context.Context, rows []queueRow) (Response, error) {
+	first := rows[0]
+	ids := make([]string, len(rows))
+	for i, r := range rows {
+		ids[i] = strconv.FormatInt(r.id, 10)
+	}
+	opts := []SendOption{WithLocale(first.email.Locale), WithBrand(first.email.Brand),
+		WithIdempotencyKey("mail_queue:" + strings.Join(ids, ","))}
+	if len(rows) == 1 {
+		return s.send(ctx, StopLossTmpl, stopLossTag, first.email.To, first.model, opts...)
+	}
+	locale := s.resolveLocale(first.email.Locale)
+	model := StopLossDigestModel{Count: len(rows)}
+	for _, r := range rows {
+		notification := make(map[string]interface{}, 2*len(r.model))
+		for k, v := range r.model {
+			notification[k] = v
+		}
+		formatNumbers(notification, r.model, locale)
+		model.Notifications = append(model.Notifications, notification)
+	}
+	data, err := templateModel(model)
+	if err != nil {
+		return Response{}, err
+	}
+	return s.send(ctx, StopLossDigestTmpl, stopLossDigestTag, first.email.To, data, opts...)
+}
@@ -0,0 +1,159 @@
+package mail
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dittotrade/internal/db"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingQueue is db.DBTX of WithDigestQueue which records inserted notifications
+type recordingQueue struct {
+	db.DBTX
+	mu   sync.Mutex
+	args [][]interface{}
+}
+
+func (q *recordingQueue) ExecContext(_ context.Context, _ string, args ...interface{}) (sql.Result, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.args = append(q.args, args)
+	return nil, nil
+}
+
+func TestService_Digest(t *testing.T) {
+	outbox := NewOutbox()
+	queue := &recordingQueue{}
+	suppressions := &memorySuppressions{}
+	ctx := context.TODO()
+	require.NoError(t, suppressions.Suppress(ctx, Suppression{Email: "bounced@ditto.trade"}))
+	cfg := testConfig
+	cfg.DigestWindow = time.Hour
+	s := New(outbox, cfg, WithDigestQueue(queue), WithSuppressionList(suppressions),
+		WithIdempotencyStore(&memoryIdempotency{}))
+
+	alpha := uuid.New()
+	require.NoError(t, s.SendNotificationStopLoss(ctx, "Investor@ditto.trade", "Alpha", alpha, 900, 1000,
+		WithLocale("de")))
+	require.Len(t, queue.args, 1)
+	args := queue.args[0]
+	require.Equal(t, []interface{}{StopLossTmpl, stopLossTag, "Investor@ditto.trade", "de", ""}, args[:5])
+	require.Equal(t, "/investor@ditto.trade", args[6])
+	require.Equal(t, time.Hour.Milliseconds(), args[7])
+	var model map[string]interface{}
+	require.NoError(t, json.Unmarshal(args[5].([]byte), &model))
+	require.Equal(t, alpha.String(), model["strategy_id"])
+
+	// notifications pass the checks of Send before they are buffered
+	err := s.SendNotificationStopLoss(ctx, "bounced@ditto.trade", "Alpha", alpha, 900, 1000)
+	require.ErrorIs(t, err, ErrSuppressed)
+	err = s.SendNotificationStopLoss(ctx, "investor@ditto.trade, qa@ditto.trade", "Alpha", alpha, 900, 1000)
+	require.ErrorIs(t, err, ErrInvalidRecipient)
+	require.NoError(t, s.SendNotificationStopLoss(ctx, "investor@ditto.trade", "Alpha", alpha, 900, 1000,
+		WithIdempotencyKey("stop_loss:1")))
+	require.NoError(t, s.SendNotificationStopLoss(ctx, "investor@ditto.trade", "Alpha", alpha, 900, 1000,
+		WithIdempotencyKey("stop_loss:1")))
+	require.Len(t, queue.args, 2)
+
+	// options which digest cannot honour are rejected
+	var res Response
+	err = s.SendNotificationStopLoss(ctx, "investor@ditto.trade", "Alpha", alpha, 900, 1000, WithResponse(&res))
+	require.ErrorIs(t, err, ErrDigestOption)
+	err = s.SendNotificationStopLoss(ctx, "investor@ditto.trade", "Alpha", alpha, 900, 1000,
+		WithMetadata("user_id", "u1"))
+	require.ErrorIs(t, err, ErrDigestOption)
+	require.Len(t, queue.args, 2)
+	require.Zero(t, outbox.Len())
+
+	// urgent and critical notifications are not buffered
+	require.NoError(t, s.SendNotificationStopLoss(ctx, "investor@ditto.trade", "Gamma", uuid.New(), 1, 2,
+		WithUrgent()))
+	require.NoError(t, s.SendNotificationStopLoss(ctx, "investor@ditto.trade", "Gamma", uuid.New(), 1, 2,
+		WithCritical()))
+	require.Equal(t, 2, outbox.Len())
+	require.Len(t, queue.args, 2)
+}
+
+func TestService_SendDigest(t *testing.T) {
+	outbox := NewOutbox()
+	s := New(outbox, testConfig, WithTemplates(DefaultTemplates()))
+	ctx := context.TODO()
+	alpha, beta := uuid.New(), uuid.New()
+	row := func(id int64, model StopLossModel) queueRow {
+		data, err := templateModel(model)
+		require.NoError(t, err)
+		// models are decoded from mail_queue
+		encoded, err := json.Marshal(data)
+		require.NoError(t, err)
+		r := queueRow{id: id, digest: "/investor@ditto.trade",
+			email: QueuedEmail{Template: StopLossTmpl, Tag: stopLossTag, To: "investor@ditto.trade"}}
+		require.NoError(t, json.Unmarshal(encoded, &r.model))
+		return r
+	}
+
+	_, err := s.sendDigest(ctx, []queueRow{
+		row(1, StopLossModel{StrategyName: "Alpha", StrategyID: alpha, Equity: 900, StopLoss: 1000}),
+		row(2, StopLossModel{StrategyName: "Beta", StrategyID: beta, Equity: 12345.6, StopLoss: 13000}),
+	})
+	require.NoError(t, err)
+	email, ok := outbox.AssertSent(t, StopLossDigestTmpl, "investor@ditto.trade")
+	require.True(t, ok)
+	require.Equal(t, stopLossDigestTag, email.Tag)
+	require.Equal(t, "2 of your strategies reached stop loss", email.Subject)
+	require.Contains(t, email.HTMLBody, "/strategies/"+alpha.String())
+	require.Contains(t, email.HTMLBody, "/strategies/"+beta.String())
+	require.Contains(t, email.TextBody, "Current equity: 12,345.60")
+	require.Contains(t, email.TextBody, "Stop loss: 13,000.00")
+
+	// single buffered notification is sent as is
+	outbox.Reset()
+	_, err = s.sendDigest(ctx, []queueRow{
+		row(3, StopLossModel{StrategyName: "Alpha", StrategyID: alpha, Equity: 900, StopLoss: 1000}),
+	})
+	require.NoError(t, err)
+	_, ok = outbox.AssertSent(t, StopLossTmpl, "investor@ditto.trade")
+	require.True(t, ok)
+}
+
+func TestDispatcher_Digest(t *testing.T) {
+	database := openTestDB(t)
+	ctx := context.TODO()
+	require.NoError(t, CreateQueueTable(ctx, database))
+
+	recipient := "digest-" + uuid.NewString() + "@ditto.trade"
+	defer func() {
+		_, _ = database.ExecContext(ctx, "DELETE FROM mail_queue WHERE recipient = $1", recipient)
+	}()
+	outbox := NewOutbox()
+	cfg := testConfig
+	cfg.DigestWindow = 50 * time.Millisecond
+	s := New(outbox, cfg, WithDigestQueue(database))
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.SendNotificationStopLoss(ctx, recipient, "Alpha", uuid.New(), 900, 1000))
+	}
+	require.Zero(t, outbox.Len())
+
+	d := NewDispatcher(database, s)
+	// the digest does not fit into a batch, but it is sent as one email
+	d.BatchSize = 2
+	require.Eventually(t, func() bool {
+		_, err := d.DispatchOnce(ctx)
+		require.NoError(t, err)
+		return len(outbox.SentTo(recipient)) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	sent := outbox.SentTo(recipient)
+	require.Len(t, sent, 1)
+	require.Equal(t, StopLossDigestTmpl, sent[0].TemplateAlias)
+	require.Equal(t, 3, sent[0].TemplateModel["count"])
+
+	var pending int
+	require.NoError(t, database.QueryRowContext(ctx, `SELECT count(*) FROM mail_queue
+		WHERE recipient = $1 AND status <> 'sent'`, recipient).Scan(&pending))
+	require.Zero(t, pending)
+}
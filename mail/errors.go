@@ -0,0 +1,105 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/keighl/postmark"
+)
+
+// Classes of delivery errors, check them with errors.Is
+var (
+	// ErrInvalidRecipient means recipient address is malformed or rejected, never retry
+	ErrInvalidRecipient = errors.New("invalid recipient")
+	// ErrInactiveRecipient means recipient hard bounced or complained before, never retry
+	ErrInactiveRecipient = errors.New("inactive recipient")
+	// ErrTemplateNotFound means template alias does not exist
+	ErrTemplateNotFound = errors.New("template not found")
+	// ErrRateLimited means provider throttles requests, retry later
+	ErrRateLimited = errors.New("rate limited")
+	// ErrTransient means network or provider failure, retry is likely to succeed
+	ErrTransient = errors.New("transient error")
+	// ErrMissingTemplateVars means model lacks variables required by template, never retry
+	ErrMissingTemplateVars = errors.New("missing template variables")
+	// ErrSuppressed means recipient is in SuppressionList and email is not critical, never retry
+	ErrSuppressed = errors.New("recipient is suppressed")
+)
+
+// Postmark API error codes, see https://postmarkapp.com/developer/api/overview#error-codes
+const (
+	postmarkInvalidEmailRequest = 300
+	postmarkInactiveRecipient   = 406
+	postmarkTemplateNotFound    = 1101
+)
+
+// SendError is returned by transports when provider refused or failed to deliver email
+type SendError struct {
+	// StatusCode is HTTP status (Postmark) or reply code (SMTP), 0 for network errors
+	StatusCode int
+	// ErrorCode is Postmark API ErrorCode
+	ErrorCode int64
+	// Kind is one of ErrInvalidRecipient, ErrInactiveRecipient, ErrTemplateNotFound,
+	// ErrRateLimited, ErrTransient or nil for other permanent errors
+	Kind error
+	Err  error
+}
+
+func (e *SendError) Error() string {
+	if e.Kind == nil {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Kind, e.Err)
+}
+
+// Unwrap returns underlying error
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches error class
+func (e *SendError) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+// IsRetryable reports whether sending may succeed if repeated later
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrTransient) || errors.Is(err, ErrRateLimited)
+}
+
+// postmarkError classifies Postmark API error by ErrorCode and HTTP status
+func postmarkError(statusCode int, apiErr postmark.APIError) *SendError {
+	e := &SendError{StatusCode: statusCode, ErrorCode: apiErr.ErrorCode, Err: apiErr}
+	switch {
+	case apiErr.ErrorCode == postmarkInactiveRecipient:
+		e.Kind = ErrInactiveRecipient
+	case apiErr.ErrorCode == postmarkTemplateNotFound:
+		e.Kind = ErrTemplateNotFound
+	case apiErr.ErrorCode == postmarkInvalidEmailRequest &&
+		(strings.Contains(apiErr.Message, "'To'") || strings.Contains(apiErr.Message, "recipient")):
+		e.Kind = ErrInvalidRecipient
+	case statusCode == http.StatusTooManyRequests:
+		e.Kind = ErrRateLimited
+	case statusCode >= http.StatusInternalServerError:
+		e.Kind = ErrTransient
+	}
+	return e
+}
+
+// smtpError classifies SMTP reply, 4xx replies are temporary by RFC 5321
+func smtpError(err error) error {
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) {
+		return &SendError{Kind: ErrTransient, Err: err}
+	}
+	e := &SendError{StatusCode: tpErr.Code, Err: err}
+	switch {
+	case tpErr.Code == 421 || tpErr.Code == 450 || tpErr.Code == 451 || tpErr.Code == 452:
+		e.Kind = ErrTransient
+	case tpErr.Code == 550 || tpErr.Code == 553:
+		e.Kind = ErrInvalidRecipient
+	}
+	return e
+}
@@ -0,0 +1,265 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states reported by Service.TransportStatus
+const (
+	// CircuitClosed transport is used
+	CircuitClosed = "closed"
+	// CircuitOpen transport failed BreakerConfig.Threshold times in a row and is skipped until Cooldown passes
+	CircuitOpen = "open"
+	// CircuitHalfOpen transport is probed by a single email, success closes the circuit and failure opens it again
+	CircuitHalfOpen = "half_open"
+)
+
+// ErrCircuitOpen is a transient error returned when no transport is available
+var ErrCircuitOpen = errors.New("transport circuit is open")
+
+// DefaultBreakerConfig is used when Config.Breaker is not set
+var DefaultBreakerConfig = BreakerConfig{
+	Threshold: 5,
+	Cooldown:  30 * time.Second,
+}
+
+type (
+	// BreakerConfig configures circuit breaker of every transport
+	BreakerConfig struct {
+		// Threshold is the number of consecutive transient errors which opens the circuit
+		Threshold int
+		// Cooldown is a pause before an open circuit is probed
+		Cooldown time.Duration
+	}
+
+	// TransportStatus is a state of transport circuit breaker for health checks
+	TransportStatus struct {
+		// Name is "primary" or "fallback<N>" where N is a position in WithFallbackTransports starting with 1,
+		// it tells apart transports of the same type
+		Name string
+		// Transport is a type of transport, e.g. "*mail.PostmarkTransport"
+		Transport string
+		State     string
+		// Failures is the number of consecutive transient errors
+		Failures int
+		// OpenedAt is a time of the last opening of the circuit
+		OpenedAt time.Time
+	}
+
+	// circuit is a transport guarded by circuit breaker
+	circuit struct {
+		name      string
+		transport Transport
+		config    BreakerConfig
+		now       func() time.Time
+
+		mu       sync.Mutex
+		state    string
+		failures int
+		openedAt time.Time
+	}
+)
+
+// WithFallbackTransports adds transports used in order when the preceding ones fail with transient errors
+// or their circuits are open. Only critical emails fail over: CategorySecurity templates and WithCritical sends.
+// Fallbacks which cannot render Postmark templates (SMTP, file) require local templates, see WithTemplates.
+func WithFallbackTransports(transports ...Transport) Option {
+	return func(s *Service) {
+		s.fallbacks = append(s.fallbacks, transports...)
+	}
+}
+
+// allow reports whether transport may be used, open circuit becomes half-open after Cooldown
+// and lets a single probe through
+func (c *circuit) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case CircuitOpen:
+		if c.now().Sub(c.openedAt) < c.config.Cooldown {
+			return false
+		}
+		c.state = CircuitHalfOpen
+		return true
+	case CircuitHalfOpen:
+		// probe is in flight
+		return false
+	default:
+		return true
+	}
+}
+
+// record updates circuit by result of transport. Transient errors open the circuit,
+// other results prove that transport works. Cancelled sends are ignored.
+func (c *circuit) record(ctx context.Context, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case err != nil && ctx.Err() != nil:
+		if c.state == CircuitHalfOpen {
+			// let the next email probe
+			c.state = CircuitOpen
+		}
+	case errors.Is(err, ErrTransient):
+		c.failures++
+		if c.state == CircuitHalfOpen || c.failures >= c.config.Threshold {
+			c.state, c.openedAt = CircuitOpen, c.now()
+		}
+	default:
+		c.state, c.failures = CircuitClosed, 0
+	}
+}
+
+func (c *circuit) status() TransportStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := c.state
+	if state == "" {
+		state = CircuitClosed
+	}
+	return TransportStatus{
+		Name:      c.name,
+		Transport: fmt.Sprintf("%T", c.transport),
+		State:     state,
+		Failures:  c.failures,
+		OpenedAt:  c.openedAt,
+	}
+}
+
+// circuits returns primary and fallback transports with their breakers
+func (s *Service) circuits() []*circuit {
+	s.circuitsOnce.Do(func() {
+		cfg := s.config.Breaker
+		if cfg.Threshold == 0 {
+			cfg = DefaultBreakerConfig
+		}
+		for i, t := range append([]Transport{s.transport}, s.fallbacks...) {
+			name := "primary"
+			if i > 0 {
+				name = fmt.Sprintf("fallback%d", i)
+			}
+			s.circuitList = append(s.circuitList, &circuit{name: name, transport: t, config: cfg, now: time.Now})
+		}
+	})
+	return s.circuitList
+}
+
+// TransportStatus returns circuit breaker states of primary and fallback transports in order
+func (s *Service) TransportStatus() []TransportStatus {
+	circuits := s.circuits()
+	res := make([]TransportStatus, len(circuits))
+	for i, c := range circuits {
+		res[i] = c.status()
+	}
+	return res
+}
+
+// Healthy reports whether any transport circuit is not open
+func (s *Service) Healthy() bool {
+	for _, st := range s.TransportStatus() {
+		if st.State != CircuitOpen {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver sends prepared email through the first available transport, fallbacks are used only for failover.
+// Permanent errors are returned as is, another provider would refuse email as well.
+func (s *Service) deliver(ctx context.Context, p prepared) (Response, error) {
+	var lastErr error
+	for i, c := range s.circuits() {
+		if i > 0 && !p.failover {
+			break
+		}
+		if !c.allow() {
+			continue
+		}
+		res, err := c.transport.Send(ctx, p.email)
+		c.record(ctx, err)
+		s.audit(p, res, err)
+		if err == nil || !IsRetryable(err) || ctx.Err() != nil {
+			return res, err
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = &SendError{Kind: ErrTransient, Err: ErrCircuitOpen}
+		s.audit(p, Response{}, lastErr)
+	}
+	return Response{}, lastErr
+}
+
+// deliverBatch sends prepared emails through the first available transport like deliver.
+// Emails which failed transiently move on to fallbacks if their failover is set.
+func (s *Service) deliverBatch(ctx context.Context, preps []prepared) []BatchResult {
+	results := make([]BatchResult, len(preps))
+	attempted := make([]bool, len(preps))
+	pending := make([]int, len(preps))
+	for i := range pending {
+		pending[i] = i
+	}
+	for ci, c := range s.circuits() {
+		if ci > 0 {
+			next := pending[:0]
+			for _, i := range pending {
+				if preps[i].failover {
+					next = append(next, i)
+				}
+			}
+			pending = next
+		}
+		if len(pending) == 0 || ctx.Err() != nil {
+			break
+		}
+		if !c.allow() {
+			continue
+		}
+		batch := make([]Email, len(pending))
+		for j, i := range pending {
+			batch[j] = preps[i].email
+		}
+		res, err := sendBatch(ctx, c.transport, batch)
+		if err != nil {
+			res = make([]BatchResult, len(batch))
+			for j := range res {
+				res[j].Err = err
+			}
+		}
+		c.record(ctx, batchError(res))
+		var retry []int
+		for j, i := range pending {
+			results[i], attempted[i] = res[j], true
+			s.audit(preps[i], res[j].Response, res[j].Err)
+			if res[j].Err != nil && IsRetryable(res[j].Err) {
+				retry = append(retry, i)
+			}
+		}
+		pending = retry
+	}
+	for i, ok := range attempted {
+		if !ok {
+			results[i].Err = &SendError{Kind: ErrTransient, Err: ErrCircuitOpen}
+			s.audit(preps[i], Response{}, results[i].Err)
+		}
+	}
+	return results
+}
+
+// batchError is a result of batch for circuit breaker: transient error when every email failed transiently,
+// otherwise the provider works
+func batchError(results []BatchResult) error {
+	for _, r := range results {
+		if r.Err == nil || !errors.Is(r.Err, ErrTransient) {
+			return nil
+		}
+	}
+	if len(results) == 0 {
+		return nil
+	}
+	return results[0].Err
+}
@@ -0,0 +1,131 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuit(t *testing.T) {
+	now := time.Now()
+	c := &circuit{config: BreakerConfig{Threshold: 2, Cooldown: time.Minute}, now: func() time.Time { return now }}
+	ctx := context.TODO()
+	transient := &SendError{Kind: ErrTransient, Err: errors.New("503")}
+
+	require.True(t, c.allow())
+	c.record(ctx, transient)
+	c.record(ctx, nil)
+	c.record(ctx, transient)
+	require.Equal(t, CircuitClosed, c.status().State)
+	c.record(ctx, transient)
+	require.Equal(t, CircuitOpen, c.status().State)
+	require.Equal(t, now, c.status().OpenedAt)
+	require.False(t, c.allow())
+
+	// a single probe after cooldown
+	now = now.Add(time.Minute)
+	require.True(t, c.allow())
+	require.False(t, c.allow())
+	require.Equal(t, CircuitHalfOpen, c.status().State)
+	c.record(ctx, transient)
+	require.Equal(t, CircuitOpen, c.status().State)
+	require.False(t, c.allow())
+
+	now = now.Add(time.Minute)
+	require.True(t, c.allow())
+	// permanent error proves that provider responds
+	c.record(ctx, &SendError{Kind: ErrInvalidRecipient, Err: errors.New("422")})
+	require.Equal(t, CircuitClosed, c.status().State)
+	require.Zero(t, c.status().Failures)
+	require.True(t, c.allow())
+}
+
+func TestService_Failover(t *testing.T) {
+	transient := &SendError{Kind: ErrTransient, Err: errors.New("503")}
+	primary := &flakyTransport{errs: []error{transient, transient, transient}}
+	secondary := NewOutbox()
+	cfg := testConfig
+	cfg.Retry = RetryPolicy{MaxAttempts: 1}
+	cfg.Breaker = BreakerConfig{Threshold: 2, Cooldown: time.Hour}
+	s := New(primary, cfg, WithFallbackTransports(secondary))
+	ctx := context.TODO()
+
+	// trading notification does not fail over
+	err := s.SendNotificationDrawdown(ctx, "investor@ditto.trade", "Alpha", uuid.New(), 20, 10)
+	require.ErrorIs(t, err, ErrTransient)
+	require.Zero(t, secondary.Len())
+
+	// OTP code fails over and opens the primary circuit
+	require.NoError(t, s.SendVerificationCode(ctx, "user01@ditto.trade", "111111"))
+	require.Equal(t, 1, secondary.Len())
+	status := s.TransportStatus()
+	require.Len(t, status, 2)
+	require.Equal(t, "primary", status[0].Name)
+	require.Equal(t, "*mail.flakyTransport", status[0].Transport)
+	require.Equal(t, "fallback1", status[1].Name)
+	require.Equal(t, CircuitOpen, status[0].State)
+	require.Equal(t, CircuitClosed, status[1].State)
+	require.True(t, s.Healthy())
+
+	// open primary is skipped
+	require.NoError(t, s.SendNotificationStopLoss(ctx, "investor@ditto.trade", "Alpha", uuid.New(), 900, 1000,
+		WithCritical()))
+	require.Equal(t, 2, primary.calls)
+	require.Equal(t, 2, secondary.Len())
+	err = s.SendNotificationDrawdown(ctx, "investor@ditto.trade", "Alpha", uuid.New(), 20, 10)
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	require.ErrorIs(t, err, ErrTransient)
+	require.Equal(t, 2, primary.calls)
+}
+
+func TestService_SendBatchFailover(t *testing.T) {
+	transient := &SendError{Kind: ErrTransient, Err: errors.New("503")}
+	primary := &flakyTransport{errs: []error{transient, transient, transient}}
+	secondary := NewOutbox()
+	cfg := testConfig
+	cfg.Retry = RetryPolicy{MaxAttempts: 1}
+	cfg.Breaker = BreakerConfig{Threshold: 2, Cooldown: time.Hour}
+	audit := &memoryAudit{}
+	s := New(primary, cfg, WithFallbackTransports(secondary), WithAuditLog(audit))
+	ctx := context.TODO()
+	otp := BatchItem{Template: VerificationCodeTmpl, Tag: "verification", To: "user01@ditto.trade",
+		Model: OTPModel{OTP: "111111"}}
+	alert := BatchItem{Template: StopLossTmpl, Tag: stopLossTag, To: "investor@ditto.trade",
+		Model: StopLossModel{StrategyName: "Alpha", StrategyID: uuid.New(), Equity: 900, StopLoss: 1000}}
+
+	// OTP code fails over, trading notification does not
+	res, err := s.SendBatch(ctx, []BatchItem{otp, alert})
+	require.ErrorIs(t, err, ErrTransient)
+	require.NoError(t, res[0].Err)
+	require.ErrorIs(t, res[1].Err, ErrTransient)
+	require.Equal(t, 1, secondary.Len())
+	require.Len(t, audit.entries, 3)
+	require.Equal(t, CircuitClosed, s.TransportStatus()[0].State)
+
+	// the whole batch failed transiently again and opened the circuit
+	_, err = s.SendBatch(ctx, []BatchItem{alert})
+	require.ErrorIs(t, err, ErrTransient)
+	require.Equal(t, CircuitOpen, s.TransportStatus()[0].State)
+
+	// open primary is skipped
+	res, err = s.SendBatch(ctx, []BatchItem{otp, alert})
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	require.NoError(t, res[0].Err)
+	require.ErrorIs(t, res[1].Err, ErrCircuitOpen)
+	require.Equal(t, 3, primary.calls)
+	require.Equal(t, 2, secondary.Len())
+}
+
+func TestService_FailoverPermanentError(t *testing.T) {
+	primary := &flakyTransport{errs: []error{&SendError{Kind: ErrInvalidRecipient, Err: errors.New("422")}}}
+	secondary := NewOutbox()
+	s := New(primary, testConfig, WithFallbackTransports(secondary))
+	err := s.SendVerificationCode(context.TODO(), "user01@ditto.trade", "111111")
+	require.ErrorIs(t, err, ErrInvalidRecipient)
+	require.Zero(t, secondary.Len())
+	require.Equal(t, CircuitClosed, s.TransportStatus()[0].State)
+}
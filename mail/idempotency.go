@@ -0,0 +1,221 @@
+package mail
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dittotrade/internal/db"
+)
+
+// IdempotencySchema creates table used by PostgresIdempotencyStore
+const IdempotencySchema = `
+create table if not exists mail_idempotency (
+	key          text primary key,
+	recipient    text not null default '',
+	message_id   text not null default '',
+	submitted_at timestamptz,
+	expires_at   timestamptz not null
+);
+create index if not exists mail_idempotency_expires_idx on mail_idempotency (expires_at);
+`
+
+// DefaultIdempotencyTTL is used when Config.IdempotencyTTL is not set
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// idempotencyLeaseMargin extends reservation of key beyond the send timeout,
+// so that the lease expires only if the sender dies
+const idempotencyLeaseMargin = time.Minute
+
+// ErrSendInProgress means email with the same idempotency key is being sent, retry later
+// to get its Response or to send it again if the first attempt fails
+var ErrSendInProgress = errors.New("email with the same idempotency key is being sent")
+
+// alertIdempotencyTTL covers a restarted checker, strategy and account alerts
+// may legitimately repeat later, e.g. margin call of the same account next day
+const alertIdempotencyTTL = time.Hour
+
+// idempotencyFields are model fields identifying business event of template,
+// they make default idempotency key together with template and recipient.
+// Copy and pause notifications may legitimately repeat, so they are not deduplicated by default.
+var idempotencyFields = map[string]string{
+	StopLossTmpl:   "strategy_id",
+	TakeProfitTmpl: "strategy_id",
+	MarginCallTmpl: "investment_account_id",
+	DrawdownTmpl:   "strategy_id",
+	DepositTmpl:    "transaction_id",
+	WithdrawalTmpl: "transaction_id",
+}
+
+// idempotencyTTLs shorten deduplication window of templates, see idempotencyTTL
+var idempotencyTTLs = map[string]time.Duration{
+	StopLossTmpl:   alertIdempotencyTTL,
+	TakeProfitTmpl: alertIdempotencyTTL,
+	MarginCallTmpl: alertIdempotencyTTL,
+	DrawdownTmpl:   alertIdempotencyTTL,
+}
+
+type (
+	// IdempotencyStore remembers sent emails by idempotency key
+	IdempotencyStore interface {
+		// Reserve claims key for lease, if key is already claimed it returns Response of the original email.
+		// Key claimed by email which is still being sent is reported by ErrSendInProgress error.
+		Reserve(ctx context.Context, key string, lease time.Duration) (original Response, reserved bool, err error)
+		// Complete records Response of email sent with reserved key for ttl
+		Complete(ctx context.Context, key string, res Response, ttl time.Duration) error
+		// Release removes reservation of email which was not sent
+		Release(ctx context.Context, key string) error
+	}
+
+	// PostgresIdempotencyStore is IdempotencyStore in mail_idempotency table
+	PostgresIdempotencyStore struct {
+		dbtx db.DBTX
+	}
+)
+
+// CreateIdempotencyTable creates mail_idempotency table if it does not exist
+func CreateIdempotencyTable(ctx context.Context, dbtx db.DBTX) error {
+	if _, err := dbtx.ExecContext(ctx, IdempotencySchema); err != nil {
+		return fmt.Errorf("could not create mail_idempotency: %w", err)
+	}
+	return nil
+}
+
+// NewPostgresIdempotencyStore creates IdempotencyStore in Postgres
+func NewPostgresIdempotencyStore(dbtx db.DBTX) *PostgresIdempotencyStore {
+	return &PostgresIdempotencyStore{dbtx: dbtx}
+}
+
+// Reserve inserts key or takes over expired one.
+// Email which is still being sent is reported by retryable ErrSendInProgress.
+func (s *PostgresIdempotencyStore) Reserve(ctx context.Context, key string, lease time.Duration) (
+	Response, bool, error) {
+	// the key may be released between the queries, then it is reserved again
+	for attempt := 0; attempt < 3; attempt++ {
+		var reserved bool
+		err := s.dbtx.QueryRowContext(ctx, `INSERT INTO mail_idempotency AS i (key, expires_at)
+			VALUES ($1, now() + $2::bigint * interval '1 millisecond')
+			ON CONFLICT (key) DO UPDATE SET recipient = '', message_id = '', submitted_at = NULL,
+				expires_at = excluded.expires_at
+			WHERE i.expires_at <= now()
+			RETURNING true`, key, lease.Milliseconds()).Scan(&reserved)
+		if err == nil {
+			return Response{}, true, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return Response{}, false, fmt.Errorf("could not reserve idempotency key %s: %w", key, err)
+		}
+		var res Response
+		var submittedAt sql.NullTime
+		err = s.dbtx.QueryRowContext(ctx, `SELECT recipient, message_id, submitted_at FROM mail_idempotency
+			WHERE key = $1`, key).Scan(&res.To, &res.MessageID, &submittedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return Response{}, false, fmt.Errorf("could not read idempotency key %s: %w", key, err)
+		}
+		if !submittedAt.Valid {
+			return Response{}, false, inProgressError(key)
+		}
+		res.SubmittedAt = submittedAt.Time
+		return res, false, nil
+	}
+	return Response{}, false, inProgressError(key)
+}
+
+// inProgressError is transient, so that duplicate is retried until the first email is sent or released
+func inProgressError(key string) error {
+	return &SendError{Kind: ErrTransient, Err: fmt.Errorf("%w: %s", ErrSendInProgress, key)}
+}
+
+// Complete stores Response and extends the key to ttl
+func (s *PostgresIdempotencyStore) Complete(ctx context.Context, key string, res Response, ttl time.Duration) error {
+	if _, err := s.dbtx.ExecContext(ctx, `UPDATE mail_idempotency SET recipient = $2, message_id = $3,
+		submitted_at = $4, expires_at = now() + $5::bigint * interval '1 millisecond' WHERE key = $1`,
+		key, res.To, res.MessageID, res.SubmittedAt, ttl.Milliseconds()); err != nil {
+		return fmt.Errorf("could not complete idempotency key %s: %w", key, err)
+	}
+	return nil
+}
+
+// Release deletes the key
+func (s *PostgresIdempotencyStore) Release(ctx context.Context, key string) error {
+	if _, err := s.dbtx.ExecContext(ctx, `DELETE FROM mail_idempotency WHERE key = $1`, key); err != nil {
+		return fmt.Errorf("could not release idempotency key %s: %w", key, err)
+	}
+	return nil
+}
+
+// Cleanup deletes expired keys
+func (s *PostgresIdempotencyStore) Cleanup(ctx context.Context) error {
+	if _, err := s.dbtx.ExecContext(ctx, `DELETE FROM mail_idempotency WHERE expires_at <= now()`); err != nil {
+		return fmt.Errorf("could not clean up mail_idempotency: %w", err)
+	}
+	return nil
+}
+
+// idempotencyKey returns explicit key of WithIdempotencyKey or default key of template,
+// empty key disables deduplication
+func (s *Service) idempotencyKey(tpl, email string, data map[string]interface{}, o sendOptions) string {
+	if s.idempotency == nil {
+		return ""
+	}
+	if o.idempotencyKey != "" {
+		return o.idempotencyKey
+	}
+	field, ok := idempotencyFields[tpl]
+	if !ok {
+		return ""
+	}
+	v, ok := data[field]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s:%s:%v", tpl, normalizeEmail(email), v)
+}
+
+// finish records result of prepared email with reserved idempotency key:
+// sent email completes the key and failed one releases it to be sent again
+func (s *Service) finish(p prepared, res Response, sendErr error) {
+	if p.key == "" {
+		return
+	}
+	// ctx of the send may be already expired, the result must be recorded anyway
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var err error
+	if sendErr != nil {
+		err = s.idempotency.Release(ctx, p.key)
+	} else {
+		// email is sent, failure to record the key must not make caller send it again
+		err = s.idempotency.Complete(ctx, p.key, res, p.ttl)
+	}
+	if err != nil {
+		log.Printf("mail: %s", err)
+	}
+}
+
+// idempotencyLease returns reservation time of key covering the whole send including retries,
+// send without timeout holds the key for idempotencyTTL
+func (s *Service) idempotencyLease(tpl string, o sendOptions) time.Duration {
+	if o.timeout <= 0 {
+		return s.idempotencyTTL(tpl)
+	}
+	return o.timeout + idempotencyLeaseMargin
+}
+
+// idempotencyTTL returns configured TTL or DefaultIdempotencyTTL of template, limited by its idempotencyTTLs
+func (s *Service) idempotencyTTL(tpl string) time.Duration {
+	ttl := s.config.IdempotencyTTL
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	if short, ok := idempotencyTTLs[tpl]; ok && short < ttl {
+		return short
+	}
+	return ttl
+}
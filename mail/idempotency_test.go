@@ -0,0 +1,173 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryIdempotency is IdempotencyStore for tests without Postgres
+type memoryIdempotency struct {
+	mu     sync.Mutex
+	keys   map[string]Response
+	leases map[string]time.Duration
+	ttls   map[string]time.Duration
+}
+
+func (m *memoryIdempotency) Reserve(_ context.Context, key string, lease time.Duration) (Response, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if res, ok := m.keys[key]; ok {
+		if res.SubmittedAt.IsZero() {
+			return Response{}, false, inProgressError(key)
+		}
+		return res, false, nil
+	}
+	if m.leases == nil {
+		m.leases = make(map[string]time.Duration)
+	}
+	m.leases[key] = lease
+	if m.keys == nil {
+		m.keys = make(map[string]Response)
+	}
+	m.keys[key] = Response{}
+	return Response{}, true, nil
+}
+
+func (m *memoryIdempotency) Complete(_ context.Context, key string, res Response, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ttls == nil {
+		m.ttls = make(map[string]time.Duration)
+	}
+	m.ttls[key] = ttl
+	m.keys[key] = res
+	return nil
+}
+
+func (m *memoryIdempotency) Release(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.keys, key)
+	return nil
+}
+
+func TestService_Idempotency(t *testing.T) {
+	outbox := NewOutbox()
+	store := &memoryIdempotency{}
+	s := New(outbox, testConfig, WithIdempotencyStore(store))
+	ctx := context.TODO()
+	transactionID := uuid.New()
+
+	var first, second Response
+	require.NoError(t, s.SendDepositConfirmation(ctx, "investor@ditto.trade", transactionID, 5000, "USD",
+		WithResponse(&first)))
+	require.NoError(t, s.SendDepositConfirmation(ctx, "Investor@ditto.trade", transactionID, 5000, "USD",
+		WithResponse(&second)))
+	require.Equal(t, 1, outbox.Len())
+	require.NotEmpty(t, first.MessageID)
+	require.Equal(t, first.MessageID, second.MessageID)
+
+	// another transaction is another event
+	require.NoError(t, s.SendDepositConfirmation(ctx, "investor@ditto.trade", uuid.New(), 5000, "USD"))
+	require.Equal(t, 2, outbox.Len())
+
+	// restarted checker does not repeat stop loss of the same strategy
+	strategyID := uuid.New()
+	require.NoError(t, s.SendNotificationStopLoss(ctx, "investor@ditto.trade", "Alpha", strategyID, 900, 1000,
+		WithResponse(&first)))
+	require.NoError(t, s.SendNotificationStopLoss(ctx, "Investor@ditto.trade", "Alpha", strategyID, 890, 1000,
+		WithResponse(&second)))
+	require.Equal(t, 3, outbox.Len())
+	require.Equal(t, first.MessageID, second.MessageID)
+	// another strategy is another event
+	require.NoError(t, s.SendNotificationStopLoss(ctx, "investor@ditto.trade", "Beta", uuid.New(), 900, 1000))
+	require.Equal(t, 4, outbox.Len())
+	// alerts are deduplicated for a shorter window, they may legitimately repeat later
+	require.Equal(t, alertIdempotencyTTL,
+		store.ttls[fmt.Sprintf("%s:investor@ditto.trade:%s", StopLossTmpl, strategyID)])
+	require.Equal(t, DefaultIdempotencyTTL,
+		store.ttls[fmt.Sprintf("%s:investor@ditto.trade:%s", DepositTmpl, transactionID)])
+
+	// failed send releases the key
+	outbox.FailWith(&SendError{Kind: ErrInvalidRecipient, Err: ErrInvalidRecipient})
+	require.Error(t, s.SendVerificationCode(ctx, "user01@ditto.trade", "111111", WithIdempotencyKey("otp-1")))
+	outbox.FailWith(nil)
+	require.NoError(t, s.SendVerificationCode(ctx, "user01@ditto.trade", "111111", WithIdempotencyKey("otp-1")))
+	require.NoError(t, s.SendVerificationCode(ctx, "user01@ditto.trade", "111111", WithIdempotencyKey("otp-1")))
+	require.Len(t, outbox.SentTo("user01@ditto.trade"), 1)
+}
+
+func TestService_IdempotencyInProgress(t *testing.T) {
+	store := &memoryIdempotency{}
+	outbox := NewOutbox()
+	s := New(outbox, testConfig, WithIdempotencyStore(store))
+	ctx := context.TODO()
+	_, reserved, err := store.Reserve(ctx, "otp-1", time.Minute)
+	require.NoError(t, err)
+	require.True(t, reserved)
+
+	// duplicate of email which is being sent is not reported as sent
+	err = s.SendVerificationCode(ctx, "user01@ditto.trade", "111111", WithIdempotencyKey("otp-1"))
+	require.ErrorIs(t, err, ErrSendInProgress)
+	require.True(t, IsRetryable(err))
+	require.Zero(t, outbox.Len())
+
+	// the first attempt failed, duplicate sends the email
+	require.NoError(t, store.Release(ctx, "otp-1"))
+	require.NoError(t, s.SendVerificationCode(ctx, "user01@ditto.trade", "111111", WithIdempotencyKey("otp-1")))
+	require.Equal(t, 1, outbox.Len())
+}
+
+func TestService_IdempotencyLease(t *testing.T) {
+	store := &memoryIdempotency{}
+	cfg := testConfig
+	cfg.Timeout = 10 * time.Second
+	s := New(NewOutbox(), cfg, WithIdempotencyStore(store))
+	ctx := context.TODO()
+	require.NoError(t, s.SendVerificationCode(ctx, "user01@ditto.trade", "111111", WithIdempotencyKey("a")))
+	require.NoError(t, s.SendVerificationCode(ctx, "user01@ditto.trade", "111111", WithIdempotencyKey("b"),
+		WithTimeout(time.Hour)))
+	require.NoError(t, s.SendVerificationCode(ctx, "user01@ditto.trade", "111111", WithIdempotencyKey("c"),
+		WithTimeout(0)))
+	require.Equal(t, 10*time.Second+idempotencyLeaseMargin, store.leases["a"])
+	require.Equal(t, time.Hour+idempotencyLeaseMargin, store.leases["b"])
+	require.Equal(t, DefaultIdempotencyTTL, store.leases["c"])
+}
+
+func TestPostgresIdempotencyStore(t *testing.T) {
+	database := openTestDB(t)
+	ctx := context.TODO()
+	require.NoError(t, CreateIdempotencyTable(ctx, database))
+	store := NewPostgresIdempotencyStore(database)
+	key := "test:" + uuid.NewString()
+	defer func() { _ = store.Release(ctx, key) }()
+
+	_, reserved, err := store.Reserve(ctx, key, time.Minute)
+	require.NoError(t, err)
+	require.True(t, reserved)
+
+	// email which is being sent is not reported as sent
+	_, reserved, err = store.Reserve(ctx, key, time.Minute)
+	require.ErrorIs(t, err, ErrSendInProgress)
+	require.True(t, IsRetryable(err))
+	require.False(t, reserved)
+	res := Response{To: "investor@ditto.trade", MessageID: uuid.NewString(), SubmittedAt: time.Now()}
+	require.NoError(t, store.Complete(ctx, key, res, time.Hour))
+
+	original, reserved, err := store.Reserve(ctx, key, time.Minute)
+	require.NoError(t, err)
+	require.False(t, reserved)
+	require.Equal(t, res.MessageID, original.MessageID)
+
+	// expired key is taken over
+	require.NoError(t, store.Complete(ctx, key, res, -time.Second))
+	_, reserved, err = store.Reserve(ctx, key, time.Minute)
+	require.NoError(t, err)
+	require.True(t, reserved)
+}
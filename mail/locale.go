@@ -0,0 +1,155 @@
+package mail
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/dittotrade/internal/utils"
+)
+
+// DefaultLocale is used when Config.DefaultLocale is not set
+const DefaultLocale = "en"
+
+// LocaleConfig overrides Config product details for recipients of a locale
+type LocaleConfig struct {
+	ProductName    string
+	SupportURL     string
+	CompanyName    string
+	CompanyAddress string
+}
+
+// numberFormat is a pair of group and decimal separators
+type numberFormat struct {
+	group, decimal string
+}
+
+var (
+	commaDecimal = numberFormat{group: ".", decimal: ","}
+	spaceDecimal = numberFormat{group: "\u00a0", decimal: ","}
+	// numberFormats by language, english format is used for others
+	numberFormats = map[string]numberFormat{
+		"de": commaDecimal, "es": commaDecimal, "it": commaDecimal, "pt": commaDecimal, "nl": commaDecimal,
+		"id": commaDecimal, "tr": commaDecimal, "vi": commaDecimal, "da": commaDecimal,
+		"fr": spaceDecimal, "ru": spaceDecimal, "uk": spaceDecimal, "pl": spaceDecimal, "cs": spaceDecimal,
+		"sv": spaceDecimal, "fi": spaceDecimal, "nb": spaceDecimal,
+		"de-ch": {group: "'", decimal: "."},
+	}
+)
+
+// FormatNumber formats v with decimals digits after the point using locale separators,
+// e.g. FormatNumber("de", 12345.6, 2) == "12.345,60"
+func FormatNumber(locale string, v float64, decimals int) string {
+	locale = normalizeLocale(locale)
+	f, ok := numberFormats[locale]
+	if !ok {
+		if f, ok = numberFormats[baseLocale(locale)]; !ok {
+			f = numberFormat{group: ",", decimal: "."}
+		}
+	}
+	s := strconv.FormatFloat(math.Abs(v), 'f', decimals, 64)
+	intPart, fracPart, _ := strings.Cut(s, ".")
+	var b strings.Builder
+	if v < 0 && strings.Trim(s, "0.") != "" {
+		b.WriteByte('-')
+	}
+	for i, d := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			b.WriteString(f.group)
+		}
+		b.WriteRune(d)
+	}
+	if fracPart != "" {
+		b.WriteString(f.decimal)
+		b.WriteString(fracPart)
+	}
+	return b.String()
+}
+
+// normalizeLocale converts "pt_BR" and "pt-BR" into "pt-br"
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
+
+// baseLocale returns language of locale: "pt-br" -> "pt"
+func baseLocale(locale string) string {
+	lang, _, _ := strings.Cut(locale, "-")
+	return lang
+}
+
+// localizedAlias is a name of template translated to locale: "stop_loss.de".
+// Local templates are directories and Postmark templates are aliases named this way.
+func localizedAlias(alias, locale string) string {
+	return alias + "." + locale
+}
+
+// defaultLocale returns configured default locale
+func (s *Service) defaultLocale() string {
+	if s.config.DefaultLocale == "" {
+		return DefaultLocale
+	}
+	return normalizeLocale(s.config.DefaultLocale)
+}
+
+// resolveLocale returns supported locale matching requested one or the default locale
+func (s *Service) resolveLocale(requested string) string {
+	requested = normalizeLocale(requested)
+	def := s.defaultLocale()
+	for _, l := range []string{requested, baseLocale(requested)} {
+		if l == "" {
+			continue
+		}
+		if l == def {
+			return def
+		}
+		if _, ok := s.config.Locales[l]; ok {
+			return l
+		}
+	}
+	return def
+}
+
+// localizedTemplate returns template alias for locale.
+// Missing local translation falls back to the default locale template,
+// Postmark is expected to have translated aliases for every configured locale.
+func (s *Service) localizedTemplate(alias, locale string) string {
+	if locale == s.defaultLocale() {
+		return alias
+	}
+	localized := localizedAlias(alias, locale)
+	if s.templates != nil && s.templates.Has(alias) && !s.templates.Has(localized) {
+		return alias
+	}
+	return localized
+}
+
+// localizedConfig returns cfg with locale overrides applied
+func localizedConfig(cfg Config, locale string) Config {
+	lc, ok := cfg.Locales[locale]
+	if !ok {
+		return cfg
+	}
+	for _, o := range []struct {
+		dst *string
+		v   string
+	}{
+		{&cfg.ProductName, lc.ProductName},
+		{&cfg.SupportURL, lc.SupportURL},
+		{&cfg.CompanyName, lc.CompanyName},
+		{&cfg.CompanyAddress, lc.CompanyAddress},
+	} {
+		if o.v != "" {
+			*o.dst = o.v
+		}
+	}
+	return cfg
+}
+
+// formatNumbers adds locale formatted copy of every float in data as <underscored key>_formatted
+func formatNumbers(payload, data map[string]interface{}, locale string) {
+	for k, v := range data {
+		if f, ok := v.(float64); ok {
+			payload[utils.Underscore(k)+"_formatted"] = FormatNumber(locale, f, 2)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/dittotrade/internal/utils"
+	"github.com/google/uuid"
+)
+
+type (
+	// OTPModel is the model of VerificationCodeTmpl, PasswordResetTmpl and DestroyAccountCodeTmpl
+	OTPModel struct {
+		OTP string `json:"otp"`
+	}
+
+	// StopLossModel is the model of StopLossTmpl.
+	// StopLoss keeps "stopLoss" name used by Postmark templates.
+	StopLossModel struct {
+		StrategyName string    `json:"strategy_name"`
+		StrategyID   uuid.UUID `json:"strategy_id"`
+		Equity       float64   `json:"equity"`
+		StopLoss     float64   `json:"stopLoss"`
+	}
+
+	// TakeProfitModel is the model of TakeProfitTmpl
+	TakeProfitModel struct {
+		StrategyName string    `json:"strategy_name"`
+		StrategyID   uuid.UUID `json:"strategy_id"`
+		Equity       float64   `json:"equity"`
+		TakeProfit   float64   `json:"take_profit"`
+	}
+
+	// MarginCallModel is the model of MarginCallTmpl, MarginLevel is a percent
+	MarginCallModel struct {
+		InvestmentAccountID uuid.UUID `json:"investment_account_id"`
+		Equity              float64   `json:"equity"`
+		MarginLevel         float64   `json:"margin_level"`
+	}
+
+	// DrawdownModel is the model of DrawdownTmpl, Drawdown and Threshold are percents
+	DrawdownModel struct {
+		StrategyName string    `json:"strategy_name"`
+		StrategyID   uuid.UUID `json:"strategy_id"`
+		Drawdown     float64   `json:"drawdown"`
+		Threshold    float64   `json:"threshold"`
+	}
+
+	// TransactionModel is the model of DepositTmpl and WithdrawalTmpl
+	TransactionModel struct {
+		TransactionID uuid.UUID `json:"transaction_id"`
+		Amount        float64   `json:"amount"`
+		Currency      string    `json:"currency"`
+	}
+
+	// CopyStartedModel is the model of CopyStartedTmpl
+	CopyStartedModel struct {
+		StrategyName string    `json:"strategy_name"`
+		StrategyID   uuid.UUID `json:"strategy_id"`
+		Amount       float64   `json:"amount"`
+	}
+
+	// CopyStoppedModel is the model of CopyStoppedTmpl
+	CopyStoppedModel struct {
+		StrategyName string    `json:"strategy_name"`
+		StrategyID   uuid.UUID `json:"strategy_id"`
+		Equity       float64   `json:"equity"`
+	}
+
+	// StrategyPausedModel is the model of StrategyPausedTmpl
+	StrategyPausedModel struct {
+		StrategyName string    `json:"strategy_name"`
+		StrategyID   uuid.UUID `json:"strategy_id"`
+		Reason       string    `json:"reason"`
+	}
+)
+
+// templateModels declare variables required by predefined templates rendered by Postmark,
+// local templates declare them by themselves
+var templateModels = map[string]interface{}{
+	VerificationCodeTmpl:   OTPModel{},
+	PasswordResetTmpl:      OTPModel{},
+	DestroyAccountCodeTmpl: OTPModel{},
+	StopLossTmpl:           StopLossModel{},
+	StopLossDigestTmpl:     StopLossDigestModel{},
+	TakeProfitTmpl:         TakeProfitModel{},
+	MarginCallTmpl:         MarginCallModel{},
+	DrawdownTmpl:           DrawdownModel{},
+	DepositTmpl:            TransactionModel{},
+	WithdrawalTmpl:         TransactionModel{},
+	CopyStartedTmpl:        CopyStartedModel{},
+	CopyStoppedTmpl:        CopyStoppedModel{},
+	StrategyPausedTmpl:     StrategyPausedModel{},
+}
+
+// Send sends template tpl to recipient email.
+// model is a struct or map[string]interface{}, struct fields are named by json tags
+// or by utils.Underscore of field names. Model is merged with Config defaults
+// and must contain all variables required by the template.
+func (s *Service) Send(ctx context.Context, tpl, tag, email string, model interface{}, opts ...SendOption) (
+	Response, error) {
+	data, err := templateModel(model)
+	if err != nil {
+		err = fmt.Errorf("could not send email: %w", err)
+		s.auditSkipped(tpl, tag, email, nil, s.sendOptions(opts), AuditStatusRefused, Response{}, err)
+		return Response{}, err
+	}
+	return s.send(ctx, tpl, tag, email, data, opts...)
+}
+
+// templateModel converts struct model into template model
+func templateModel(model interface{}) (map[string]interface{}, error) {
+	if m, ok := model.(map[string]interface{}); ok {
+		return m, nil
+	}
+	res := make(map[string]interface{})
+	if model == nil {
+		return res, nil
+	}
+	v := reflect.ValueOf(model)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return res, nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("model must be a struct or map[string]interface{}, got %T", model)
+	}
+	addFields(res, v)
+	return res, nil
+}
+
+// addFields adds exported fields of struct v to model, embedded structs are flattened
+func addFields(model map[string]interface{}, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+		// exported fields of embedded struct are promoted even if the struct type is not exported
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			addFields(model, v.Field(i))
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = utils.Underscore(f.Name)
+		}
+		if strings.Contains(opts, "omitempty") && v.Field(i).IsZero() {
+			continue
+		}
+		model[name] = v.Field(i).Interface()
+	}
+}
+
+// requiredVars returns variables used by local template alias or declared by model of predefined template tpl
+func (s *Service) requiredVars(alias, tpl string) []string {
+	if s.templates != nil && s.templates.Has(alias) {
+		return s.templates.Vars(alias)
+	}
+	model, ok := templateModels[tpl]
+	if !ok {
+		return nil
+	}
+	m, _ := templateModel(model)
+	vars := make([]string, 0, len(m))
+	for k := range m {
+		vars = append(vars, k)
+	}
+	sort.Strings(vars)
+	return vars
+}
+
+// validateModel checks that model has every variable required by template
+func (s *Service) validateModel(alias, tpl string, model map[string]interface{}) error {
+	var missing []string
+	for _, v := range s.requiredVars(alias, tpl) {
+		if _, ok := model[v]; !ok {
+			missing = append(missing, v)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s requires %s", ErrMissingTemplateVars, alias, strings.Join(missing, ", "))
+	}
+	return nil
+}
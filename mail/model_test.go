@@ -0,0 +1,63 @@
+package mail
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+type baseModel struct {
+	UserName string
+}
+
+type testModel struct {
+	baseModel
+	StrategyName  string  `json:"strategy_name"`
+	CurrentEquity float64 // no tag: utils.Underscore
+	Note          string  `json:",omitempty"`
+	Secret        string  `json:"-"`
+	hidden        string
+}
+
+func TestTemplateModel(t *testing.T) {
+	m, err := templateModel(&testModel{baseModel: baseModel{UserName: "ann"}, StrategyName: "Alpha", CurrentEquity: 1.5,
+		Secret: "x", hidden: "y"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"user_name": "ann", "strategy_name": "Alpha", "current_equity": 1.5}, m)
+
+	_, err = templateModel(42)
+	require.Error(t, err)
+}
+
+func TestService_Send(t *testing.T) {
+	outbox := NewOutbox()
+	s := New(outbox, testConfig)
+	ctx := context.TODO()
+
+	_, err := s.Send(ctx, StopLossTmpl, "investment_stop_loss", "investor@ditto.trade",
+		map[string]interface{}{"strategy_name": "Alpha", "stop_loss": 1000.0})
+	require.ErrorIs(t, err, ErrMissingTemplateVars)
+	require.Contains(t, err.Error(), "equity, stopLoss, strategy_id")
+	require.Zero(t, outbox.Len())
+
+	res, err := s.Send(ctx, "custom", "custom", "investor@ditto.trade", testModel{StrategyName: "Alpha"})
+	require.NoError(t, err)
+	require.NotEmpty(t, res.MessageID)
+	email, _ := outbox.AssertSent(t, "custom", "investor@ditto.trade")
+	require.Equal(t, "Alpha", email.TemplateModel["strategy_name"])
+	require.Equal(t, testConfig.ProductURL, email.TemplateModel["product_url"])
+
+	// local templates require variables they use
+	templates, err := LoadTemplates(fstest.MapFS{
+		"custom/subject.txt": {Data: []byte("{{.strategy_name}}")},
+		"custom/body.html":   {Data: []byte(`{{range .items}}{{.name}}{{end}}{{with $.note}}{{.}}{{end}}`)},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"items", "note", "strategy_name"}, templates.Vars("custom"))
+	s = New(outbox, testConfig, WithTemplates(templates))
+	_, err = s.Send(ctx, "custom", "custom", "investor@ditto.trade", testModel{StrategyName: "Alpha"})
+	require.ErrorIs(t, err, ErrMissingTemplateVars)
+	require.Contains(t, err.Error(), "items, note")
+}
@@ -0,0 +1,126 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// Predefined trading notification templates
+var (
+	TakeProfitTmpl     = "take_profit"
+	MarginCallTmpl     = "margin_call"
+	DrawdownTmpl       = "drawdown"
+	DepositTmpl        = "deposit_confirmation"
+	WithdrawalTmpl     = "withdrawal_confirmation"
+	CopyStartedTmpl    = "copy_started"
+	CopyStoppedTmpl    = "copy_stopped"
+	StrategyPausedTmpl = "strategy_paused"
+)
+
+// SendNotificationTakeProfit notifies investor that copying of strategy stopped at take profit level.
+func (s *Service) SendNotificationTakeProfit(ctx context.Context, email, strategyName string, strategyID uuid.UUID,
+	currentEquity, takeProfit float64, opts ...SendOption) error {
+	if _, err := s.Send(ctx, TakeProfitTmpl, "investment_take_profit", email, TakeProfitModel{
+		StrategyName: strategyName,
+		StrategyID:   strategyID,
+		Equity:       currentEquity,
+		TakeProfit:   takeProfit,
+	}, opts...); err != nil {
+		return fmt.Errorf("could not send take profit notification: %w", err)
+	}
+	return nil
+}
+
+// SendNotificationMarginCall warns investor that equity of investment account is low.
+func (s *Service) SendNotificationMarginCall(ctx context.Context, email string, investmentAccountID uuid.UUID,
+	currentEquity, marginLevel float64, opts ...SendOption) error {
+	if _, err := s.Send(ctx, MarginCallTmpl, "margin_call", email, MarginCallModel{
+		InvestmentAccountID: investmentAccountID,
+		Equity:              currentEquity,
+		MarginLevel:         marginLevel,
+	}, opts...); err != nil {
+		return fmt.Errorf("could not send margin call notification: %w", err)
+	}
+	return nil
+}
+
+// SendNotificationDrawdown notifies investor that drawdown of strategy exceeded threshold.
+func (s *Service) SendNotificationDrawdown(ctx context.Context, email, strategyName string, strategyID uuid.UUID,
+	drawdown, threshold float64, opts ...SendOption) error {
+	if _, err := s.Send(ctx, DrawdownTmpl, "investment_drawdown", email, DrawdownModel{
+		StrategyName: strategyName,
+		StrategyID:   strategyID,
+		Drawdown:     drawdown,
+		Threshold:    threshold,
+	}, opts...); err != nil {
+		return fmt.Errorf("could not send drawdown notification: %w", err)
+	}
+	return nil
+}
+
+// SendDepositConfirmation confirms that deposit is credited.
+func (s *Service) SendDepositConfirmation(ctx context.Context, email string, transactionID uuid.UUID, amount float64,
+	currency string, opts ...SendOption) error {
+	if _, err := s.Send(ctx, DepositTmpl, "deposit", email, TransactionModel{
+		TransactionID: transactionID,
+		Amount:        amount,
+		Currency:      currency,
+	}, opts...); err != nil {
+		return fmt.Errorf("could not send deposit confirmation: %w", err)
+	}
+	return nil
+}
+
+// SendWithdrawalConfirmation confirms that withdrawal is processed.
+func (s *Service) SendWithdrawalConfirmation(ctx context.Context, email string, transactionID uuid.UUID,
+	amount float64, currency string, opts ...SendOption) error {
+	if _, err := s.Send(ctx, WithdrawalTmpl, "withdrawal", email, TransactionModel{
+		TransactionID: transactionID,
+		Amount:        amount,
+		Currency:      currency,
+	}, opts...); err != nil {
+		return fmt.Errorf("could not send withdrawal confirmation: %w", err)
+	}
+	return nil
+}
+
+// SendNotificationCopyStarted notifies investor that copying of strategy started.
+func (s *Service) SendNotificationCopyStarted(ctx context.Context, email, strategyName string, strategyID uuid.UUID,
+	amount float64, opts ...SendOption) error {
+	if _, err := s.Send(ctx, CopyStartedTmpl, "copy_started", email, CopyStartedModel{
+		StrategyName: strategyName,
+		StrategyID:   strategyID,
+		Amount:       amount,
+	}, opts...); err != nil {
+		return fmt.Errorf("could not send copy started notification: %w", err)
+	}
+	return nil
+}
+
+// SendNotificationCopyStopped notifies investor that copying of strategy stopped.
+func (s *Service) SendNotificationCopyStopped(ctx context.Context, email, strategyName string, strategyID uuid.UUID,
+	currentEquity float64, opts ...SendOption) error {
+	if _, err := s.Send(ctx, CopyStoppedTmpl, "copy_stopped", email, CopyStoppedModel{
+		StrategyName: strategyName,
+		StrategyID:   strategyID,
+		Equity:       currentEquity,
+	}, opts...); err != nil {
+		return fmt.Errorf("could not send copy stopped notification: %w", err)
+	}
+	return nil
+}
+
+// SendNotificationStrategyPaused notifies investor that pro trader paused copied strategy.
+func (s *Service) SendNotificationStrategyPaused(ctx context.Context, email, strategyName string,
+	strategyID uuid.UUID, reason string, opts ...SendOption) error {
+	if _, err := s.Send(ctx, StrategyPausedTmpl, "strategy_paused", email, StrategyPausedModel{
+		StrategyName: strategyName,
+		StrategyID:   strategyID,
+		Reason:       reason,
+	}, opts...); err != nil {
+		return fmt.Errorf("could not send strategy paused notification: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package mail
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_TradingNotifications(t *testing.T) {
+	outbox := NewOutbox()
+	s := New(outbox, testConfig, WithTemplates(DefaultTemplates()))
+	ctx := context.TODO()
+	strategyID, accountID, txID := uuid.New(), uuid.New(), uuid.New()
+	to := "investor@ditto.trade"
+
+	require.NoError(t, s.SendNotificationTakeProfit(ctx, to, "Alpha", strategyID, 1500, 1400))
+	require.NoError(t, s.SendNotificationMarginCall(ctx, to, accountID, 120, 35.5))
+	require.NoError(t, s.SendNotificationDrawdown(ctx, to, "Alpha", strategyID, 21.25, 20))
+	require.NoError(t, s.SendDepositConfirmation(ctx, to, txID, 1000, "USD"))
+	require.NoError(t, s.SendWithdrawalConfirmation(ctx, to, txID, 250.5, "USD"))
+	require.NoError(t, s.SendNotificationCopyStarted(ctx, to, "Alpha", strategyID, 1000))
+	require.NoError(t, s.SendNotificationCopyStopped(ctx, to, "Alpha", strategyID, 1010))
+	require.NoError(t, s.SendNotificationStrategyPaused(ctx, to, "Alpha", strategyID, ""))
+	require.Equal(t, 8, outbox.Len())
+
+	email, ok := outbox.AssertSent(t, TakeProfitTmpl, to)
+	require.True(t, ok)
+	require.Equal(t, "investment_take_profit", email.Tag)
+	require.Contains(t, email.TextBody, "Take profit: 1,400.00")
+
+	email, _ = outbox.AssertSent(t, MarginCallTmpl, to)
+	require.Contains(t, email.TextBody, "Margin level: 35.50%")
+	require.Contains(t, email.TextBody, accountID.String())
+
+	email, _ = outbox.AssertSent(t, WithdrawalTmpl, to)
+	require.Equal(t, "Withdrawal processed: 250.50 USD", email.Subject)
+
+	email, _ = outbox.AssertSent(t, StrategyPausedTmpl, to)
+	require.NotContains(t, email.TextBody, "Reason")
+}
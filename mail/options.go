@@ -0,0 +1,189 @@
+package mail
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/dittotrade/internal/db"
+)
+
+type (
+	// Option configures Service
+	Option func(*Service)
+
+	// SendOption customizes a single Send* call
+	SendOption func(*sendOptions)
+
+	sendOptions struct {
+		timeout        time.Duration
+		locale         string
+		critical       bool
+		idempotencyKey string
+		response       *Response
+		attachments    []Attachment
+		metadata       map[string]string
+		urgent         bool
+		brand          string
+	}
+)
+
+// WithTransport makes Service deliver emails through transport instead of the one selected by Config
+func WithTransport(transport Transport) Option {
+	return func(s *Service) {
+		s.transport = transport
+	}
+}
+
+// WithHTTPClient sets http.Client of Postmark transport built by NewService
+func WithHTTPClient(client *http.Client) Option {
+	return func(s *Service) {
+		s.httpClient = client
+	}
+}
+
+// WithTemplates makes Service render emails locally and send them raw.
+// Templates missing in the registry are still sent by alias (Postmark templates).
+func WithTemplates(templates *Templates) Option {
+	return func(s *Service) {
+		s.templates = templates
+	}
+}
+
+// WithSuppressionList makes Service refuse recipients in the list, see WithCritical
+func WithSuppressionList(suppressions SuppressionList) Option {
+	return func(s *Service) {
+		s.suppressions = suppressions
+	}
+}
+
+// WithRateLimiter replaces in-process rate limiter, e.g. with PostgresRateLimiter shared by replicas
+func WithRateLimiter(limiter RateLimiter) Option {
+	return func(s *Service) {
+		s.limiter = limiter
+	}
+}
+
+// WithIdempotencyStore makes repeated sends of the same event within Config.IdempotencyTTL no-ops,
+// strategy and account alerts are deduplicated for an hour at most
+func WithIdempotencyStore(store IdempotencyStore) Option {
+	return func(s *Service) {
+		s.idempotency = store
+	}
+}
+
+// WithCategoryStream sends templates of category (e.g. CategoryMarketing) through Postmark message stream
+func WithCategoryStream(category, stream string) Option {
+	return func(s *Service) {
+		if s.streams == nil {
+			s.streams = make(map[string]string)
+		}
+		s.streams[category] = stream
+	}
+}
+
+// WithTemplateCategory sets category of custom template or overrides category of predefined one
+func WithTemplateCategory(tpl, category string) Option {
+	return func(s *Service) {
+		if s.categories == nil {
+			s.categories = make(map[string]string)
+		}
+		s.categories[tpl] = category
+	}
+}
+
+// WithPreferences makes Service skip emails of categories which recipient opted out of,
+// security emails and WithCritical sends are not skipped
+func WithPreferences(preferences Preferences) Option {
+	return func(s *Service) {
+		s.preferences = preferences
+	}
+}
+
+// WithAuditLog records every send attempt, e.g. into PostgresAuditLog
+func WithAuditLog(auditLog AuditLog) Option {
+	return func(s *Service) {
+		s.auditLog = auditLog
+	}
+}
+
+// WithDigestQueue stores stop loss notifications buffered for Config.DigestWindow in mail_queue of dbtx,
+// Dispatcher sends them as digests. Digests are disabled without it.
+func WithDigestQueue(dbtx db.DBTX) Option {
+	return func(s *Service) {
+		s.digestQueue = dbtx
+	}
+}
+
+// WithTimeout overrides Config.Timeout for a single call, zero or negative disables timeout
+func WithTimeout(timeout time.Duration) SendOption {
+	return func(o *sendOptions) {
+		o.timeout = timeout
+	}
+}
+
+// sendOptions applies opts over Service defaults
+func (s *Service) sendOptions(opts []SendOption) sendOptions {
+	o := sendOptions{timeout: s.config.Timeout}
+	if o.timeout == 0 {
+		o.timeout = DefaultTimeout
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithLocale selects recipient locale of email, unsupported locale falls back to Config.DefaultLocale
+func WithLocale(locale string) SendOption {
+	return func(o *sendOptions) {
+		o.locale = locale
+	}
+}
+
+// WithCritical sends email even if recipient is suppressed, e.g. security notifications
+func WithCritical() SendOption {
+	return func(o *sendOptions) {
+		o.critical = true
+	}
+}
+
+// WithUrgent sends notification immediately even if Config.DigestWindow is set
+func WithUrgent() SendOption {
+	return func(o *sendOptions) {
+		o.urgent = true
+	}
+}
+
+// WithIdempotencyKey replaces default deduplication key (template, recipient and business key, e.g. strategy_id).
+// It has no effect unless Service has IdempotencyStore.
+func WithIdempotencyKey(key string) SendOption {
+	return func(o *sendOptions) {
+		o.idempotencyKey = key
+	}
+}
+
+// WithResponse stores Response of sent email into dst,
+// deduplicated send stores Response of the original email
+func WithResponse(dst *Response) SendOption {
+	return func(o *sendOptions) {
+		o.response = dst
+	}
+}
+
+// WithAttachments attaches files to email, Reader of attachment is read once before sending
+func WithAttachments(attachments ...Attachment) SendOption {
+	return func(o *sendOptions) {
+		o.attachments = append(o.attachments, attachments...)
+	}
+}
+
+// WithMetadata attaches metadata to email, user_id, strategy_id and investment_account_id
+// variables of the model are attached automatically
+func WithMetadata(key, value string) SendOption {
+	return func(o *sendOptions) {
+		if o.metadata == nil {
+			o.metadata = make(map[string]string)
+		}
+		o.metadata[key] = value
+	}
+}
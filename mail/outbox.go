@@ -0,0 +1,223 @@
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type (
+	// Outbox is a Transport which captures emails in memory instead of sending them.
+	// It is intended for tests and local development.
+	Outbox struct {
+		mu     sync.Mutex
+		emails []Email
+		err    error
+	}
+
+	// FileOutbox is a Transport which writes every email into directory
+	// as <name>.json (Email itself) and <name>.eml (rendered message)
+	FileOutbox struct {
+		dir    string
+		render RenderFunc
+	}
+
+	// TestingT is implemented by *testing.T
+	TestingT interface {
+		Errorf(format string, args ...interface{})
+	}
+)
+
+// NewOutbox creates empty in-memory Outbox
+func NewOutbox() *Outbox {
+	return &Outbox{}
+}
+
+// Send records email, it returns error set by FailWith if any
+func (o *Outbox) Send(ctx context.Context, email Email) (Response, error) {
+	if err := ctx.Err(); err != nil {
+		return Response{}, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.err != nil {
+		return Response{}, o.err
+	}
+	model := make(map[string]interface{}, len(email.TemplateModel))
+	for k, v := range email.TemplateModel {
+		model[k] = v
+	}
+	email.TemplateModel = model
+	email.Attachments = append([]Attachment(nil), email.Attachments...)
+	if email.Metadata != nil {
+		metadata := make(map[string]string, len(email.Metadata))
+		for k, v := range email.Metadata {
+			metadata[k] = v
+		}
+		email.Metadata = metadata
+	}
+	o.emails = append(o.emails, email)
+	return Response{To: email.To, MessageID: uuid.NewString(), SubmittedAt: time.Now()}, nil
+}
+
+// SendBatch records emails like Send
+func (o *Outbox) SendBatch(ctx context.Context, emails []Email) ([]BatchResult, error) {
+	return sendEach(ctx, o, emails), nil
+}
+
+// FailWith makes all following Send calls return err, nil restores normal behaviour
+func (o *Outbox) FailWith(err error) {
+	o.mu.Lock()
+	o.err = err
+	o.mu.Unlock()
+}
+
+// Emails returns copy of all captured emails in order of sending
+func (o *Outbox) Emails() []Email {
+	return o.Find(func(Email) bool { return true })
+}
+
+// Len returns number of captured emails
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.emails)
+}
+
+// Last returns the most recent captured email
+func (o *Outbox) Last() (Email, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.emails) == 0 {
+		return Email{}, false
+	}
+	return o.emails[len(o.emails)-1], true
+}
+
+// Find returns captured emails matching predicate
+func (o *Outbox) Find(match func(Email) bool) []Email {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var res []Email
+	for _, e := range o.emails {
+		if match(e) {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// SentTo returns emails sent to recipient
+func (o *Outbox) SentTo(recipient string) []Email {
+	return o.Find(func(e Email) bool { return strings.EqualFold(e.To, recipient) })
+}
+
+// WithTemplate returns emails sent using template alias
+func (o *Outbox) WithTemplate(alias string) []Email {
+	return o.Find(func(e Email) bool { return e.TemplateAlias == alias })
+}
+
+// Reset removes all captured emails
+func (o *Outbox) Reset() {
+	o.mu.Lock()
+	o.emails = nil
+	o.mu.Unlock()
+}
+
+// AssertSent checks that exactly one email with template alias was sent to recipient and returns it
+func (o *Outbox) AssertSent(t TestingT, alias, recipient string) (Email, bool) {
+	if h, ok := t.(interface{ Helper() }); ok {
+		h.Helper()
+	}
+	found := o.Find(func(e Email) bool { return e.TemplateAlias == alias && strings.EqualFold(e.To, recipient) })
+	if len(found) != 1 {
+		t.Errorf("expected 1 email %q to %s, found %d of %d captured", alias, recipient, len(found), o.Len())
+		return Email{}, false
+	}
+	return found[0], true
+}
+
+// AssertNotSent checks that no email with template alias was sent to recipient
+func (o *Outbox) AssertNotSent(t TestingT, alias, recipient string) bool {
+	if h, ok := t.(interface{ Helper() }); ok {
+		h.Helper()
+	}
+	found := o.Find(func(e Email) bool { return e.TemplateAlias == alias && strings.EqualFold(e.To, recipient) })
+	if len(found) != 0 {
+		t.Errorf("expected no email %q to %s, found %d", alias, recipient, len(found))
+		return false
+	}
+	return true
+}
+
+// AssertModel checks that email model contains key with value
+func AssertModel(t TestingT, email Email, key string, value interface{}) bool {
+	if h, ok := t.(interface{ Helper() }); ok {
+		h.Helper()
+	}
+	got, ok := email.TemplateModel[key]
+	if !ok {
+		t.Errorf("email %q to %s: model has no key %q", email.TemplateAlias, email.To, key)
+		return false
+	}
+	if fmt.Sprint(got) != fmt.Sprint(value) {
+		t.Errorf("email %q to %s: model[%q] = %v, want %v", email.TemplateAlias, email.To, key, got, value)
+		return false
+	}
+	return true
+}
+
+// NewFileOutbox creates FileOutbox writing into dir, DefaultTemplates are used when render is nil
+func NewFileOutbox(dir string, render RenderFunc) (*FileOutbox, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create outbox dir: %w", err)
+	}
+	if render == nil {
+		render = DefaultTemplates().RenderEmail
+	}
+	return &FileOutbox{dir: dir, render: render}, nil
+}
+
+// SendBatch writes emails like Send
+func (o *FileOutbox) SendBatch(ctx context.Context, emails []Email) ([]BatchResult, error) {
+	return sendEach(ctx, o, emails), nil
+}
+
+// Send writes email files into outbox directory
+func (o *FileOutbox) Send(ctx context.Context, email Email) (Response, error) {
+	if err := ctx.Err(); err != nil {
+		return Response{}, err
+	}
+	now := time.Now()
+	res := Response{To: email.To, MessageID: newMessageID(email.From), SubmittedAt: now}
+	name := filepath.Join(o.dir, fmt.Sprintf("%s-%s-%s", now.Format("20060102T150405.000000"),
+		email.TemplateAlias, uuid.NewString()[:8]))
+
+	data, err := json.MarshalIndent(email, "", "  ")
+	if err != nil {
+		return Response{}, fmt.Errorf("outbox: %w", err)
+	}
+	if err = os.WriteFile(name+".json", data, 0o644); err != nil {
+		return Response{}, fmt.Errorf("outbox: %w", err)
+	}
+
+	subject, htmlBody, textBody, err := renderEmail(email, o.render)
+	if err != nil {
+		return Response{}, fmt.Errorf("outbox: could not render template %s: %w", email.TemplateAlias, err)
+	}
+	msg, err := buildMessage(email, subject, htmlBody, textBody, res.MessageID, now)
+	if err != nil {
+		return Response{}, fmt.Errorf("outbox: %w", err)
+	}
+	if err = os.WriteFile(name+".eml", msg, 0o644); err != nil {
+		return Response{}, fmt.Errorf("outbox: %w", err)
+	}
+	return res, nil
+}
@@ -0,0 +1,50 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutbox(t *testing.T) {
+	outbox := NewOutbox()
+	s := New(outbox, testConfig)
+	ctx := context.TODO()
+	require.NoError(t, s.SendVerificationCode(ctx, "user01@ditto.trade", "111111"))
+	require.NoError(t, s.SendResetPasswordCode(ctx, "user02@ditto.trade", "222222"))
+	require.Equal(t, 2, outbox.Len())
+	require.Len(t, outbox.SentTo("USER01@ditto.trade"), 1)
+	require.Len(t, outbox.WithTemplate(PasswordResetTmpl), 1)
+	last, ok := outbox.Last()
+	require.True(t, ok)
+	AssertModel(t, last, "otp", "222222")
+	outbox.AssertNotSent(t, DestroyAccountCodeTmpl, "user01@ditto.trade")
+
+	errDown := errors.New("down")
+	outbox.FailWith(errDown)
+	require.ErrorIs(t, s.SendVerificationCode(ctx, "user01@ditto.trade", "333333"), errDown)
+	outbox.Reset()
+	require.Zero(t, outbox.Len())
+}
+
+func TestFileOutbox(t *testing.T) {
+	dir := t.TempDir()
+	outbox, err := NewFileOutbox(dir, nil)
+	require.NoError(t, err)
+	s := New(outbox, testConfig)
+	require.NoError(t, s.SendVerificationCode(context.TODO(), "user01@ditto.trade", "111111"))
+	files, err := filepath.Glob(filepath.Join(dir, "*"+VerificationCodeTmpl+"*"))
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		require.NoError(t, err)
+		require.Contains(t, string(data), "111111")
+		require.True(t, strings.HasSuffix(f, ".json") || strings.HasSuffix(f, ".eml"))
+	}
+}
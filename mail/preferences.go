@@ -0,0 +1,186 @@
+package mail
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/dittotrade/internal/db"
+	"github.com/dittotrade/internal/utils"
+)
+
+// PreferencesSchema creates table used by PostgresPreferences
+const PreferencesSchema = `
+create table if not exists mail_preferences (
+	email      text not null,
+	category   text not null,
+	opted_out  boolean not null,
+	updated_at timestamptz not null default now(),
+	primary key (email, category)
+);
+`
+
+var (
+	// ErrOptedOut means recipient opted out of template category and email is not critical, never retry
+	ErrOptedOut = errors.New("recipient opted out")
+	// ErrInvalidUnsubscribeToken is returned by VerifyUnsubscribeToken for malformed or forged tokens
+	ErrInvalidUnsubscribeToken = errors.New("invalid unsubscribe token")
+)
+
+type (
+	// Preferences are opt-outs of recipients by template category
+	Preferences interface {
+		OptedOut(ctx context.Context, email, category string) (bool, error)
+		SetOptedOut(ctx context.Context, email, category string, optedOut bool) error
+	}
+
+	// PostgresPreferences is Preferences in mail_preferences table
+	PostgresPreferences struct {
+		dbtx db.DBTX
+	}
+)
+
+// optional reports whether recipients may opt out of category,
+// security emails and templates without category are always sent
+func optional(category string) bool {
+	return category != "" && category != CategorySecurity
+}
+
+// CreatePreferencesTable creates mail_preferences table if it does not exist
+func CreatePreferencesTable(ctx context.Context, dbtx db.DBTX) error {
+	if _, err := dbtx.ExecContext(ctx, PreferencesSchema); err != nil {
+		return fmt.Errorf("could not create mail_preferences: %w", err)
+	}
+	return nil
+}
+
+// NewPostgresPreferences creates Preferences in Postgres
+func NewPostgresPreferences(dbtx db.DBTX) *PostgresPreferences {
+	return &PostgresPreferences{dbtx: dbtx}
+}
+
+// OptedOut reports whether email opted out of category, recipients are opted in by default
+func (p *PostgresPreferences) OptedOut(ctx context.Context, email, category string) (bool, error) {
+	var optedOut bool
+	err := p.dbtx.QueryRowContext(ctx, `SELECT opted_out FROM mail_preferences WHERE email = $1 AND category = $2`,
+		normalizeEmail(email), category).Scan(&optedOut)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not check preferences of %s: %w", email, err)
+	}
+	return optedOut, nil
+}
+
+// SetOptedOut stores preference of email for category
+func (p *PostgresPreferences) SetOptedOut(ctx context.Context, email, category string, optedOut bool) error {
+	if _, err := p.dbtx.ExecContext(ctx, `INSERT INTO mail_preferences(email, category, opted_out) VALUES ($1,$2,$3)
+		ON CONFLICT (email, category) DO UPDATE SET opted_out = excluded.opted_out, updated_at = now()`,
+		normalizeEmail(email), category, optedOut); err != nil {
+		return fmt.Errorf("could not store preferences of %s: %w", email, err)
+	}
+	return nil
+}
+
+// Preferences returns stored opt-outs of email by category, e.g. for a settings page
+func (p *PostgresPreferences) Preferences(ctx context.Context, email string) (res map[string]bool, err error) {
+	rows, err := p.dbtx.QueryContext(ctx, `SELECT category, opted_out FROM mail_preferences WHERE email = $1`,
+		normalizeEmail(email))
+	if err != nil {
+		return nil, fmt.Errorf("could not query preferences of %s: %w", email, err)
+	}
+	defer utils.CloseOrErr(rows, &err)
+	res = make(map[string]bool)
+	for rows.Next() {
+		var category string
+		var optedOut bool
+		if err = rows.Scan(&category, &optedOut); err != nil {
+			return nil, err
+		}
+		res[category] = optedOut
+	}
+	return res, rows.Err()
+}
+
+// UnsubscribeToken signs email and category with secret for one-click unsubscribe links
+func UnsubscribeToken(secret, email, category string) string {
+	payload := normalizeEmail(email) + "\n" + category
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(unsubscribeSignature(secret, payload))
+}
+
+// VerifyUnsubscribeToken returns email and category of token signed by UnsubscribeToken with secret
+func VerifyUnsubscribeToken(secret, token string) (email, category string, err error) {
+	encoded, encodedSig, ok := strings.Cut(token, ".")
+	if !ok || secret == "" {
+		return "", "", ErrInvalidUnsubscribeToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", ErrInvalidUnsubscribeToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil || !hmac.Equal(sig, unsubscribeSignature(secret, string(payload))) {
+		return "", "", ErrInvalidUnsubscribeToken
+	}
+	email, category, ok = strings.Cut(string(payload), "\n")
+	if !ok || email == "" || category == "" {
+		return "", "", ErrInvalidUnsubscribeToken
+	}
+	return email, category, nil
+}
+
+func unsubscribeSignature(secret, payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// Unsubscribe opts recipient out of category of token generated for unsubscribe_url template variable
+func (s *Service) Unsubscribe(ctx context.Context, token string) error {
+	if s.preferences == nil {
+		return fmt.Errorf("could not unsubscribe: %w: Service has no Preferences", ErrInvalidConfig)
+	}
+	email, category, err := VerifyUnsubscribeToken(s.config.UnsubscribeSecret, token)
+	if err != nil {
+		return fmt.Errorf("could not unsubscribe: %w", err)
+	}
+	if !optional(category) {
+		return fmt.Errorf("could not unsubscribe from %s emails: %w", category, ErrInvalidUnsubscribeToken)
+	}
+	return s.preferences.SetOptedOut(ctx, email, category, true)
+}
+
+// checkPreferences returns ErrOptedOut if recipient opted out of category of tpl
+func (s *Service) checkPreferences(ctx context.Context, tpl, email string, o sendOptions) error {
+	category := s.category(tpl)
+	if s.preferences == nil || o.critical || !optional(category) {
+		return nil
+	}
+	optedOut, err := s.preferences.OptedOut(ctx, email, category)
+	if err != nil {
+		return err
+	}
+	if optedOut {
+		return fmt.Errorf("%w of %s emails", ErrOptedOut, category)
+	}
+	return nil
+}
+
+// unsubscribeURL returns one-click unsubscribe link for footer of optional emails,
+// it is empty when Config.UnsubscribeURL is not set
+func (s *Service) unsubscribeURL(tpl, email string) string {
+	category := s.category(tpl)
+	if s.config.UnsubscribeURL == "" || !optional(category) {
+		return ""
+	}
+	return s.config.UnsubscribeURL + "?token=" + url.QueryEscape(UnsubscribeToken(s.config.UnsubscribeSecret, email,
+		category))
+}
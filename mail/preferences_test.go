@@ -0,0 +1,162 @@
+package mail
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryPreferences is Preferences for tests without Postgres
+type memoryPreferences struct {
+	mu        sync.Mutex
+	optedOuts map[string]bool
+}
+
+func (m *memoryPreferences) OptedOut(_ context.Context, email, category string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.optedOuts[normalizeEmail(email)+"/"+category], nil
+}
+
+func (m *memoryPreferences) SetOptedOut(_ context.Context, email, category string, optedOut bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.optedOuts == nil {
+		m.optedOuts = make(map[string]bool)
+	}
+	m.optedOuts[normalizeEmail(email)+"/"+category] = optedOut
+	return nil
+}
+
+func TestUnsubscribeToken(t *testing.T) {
+	token := UnsubscribeToken("secret", "Investor@ditto.trade", CategoryTradingAlerts)
+	email, category, err := VerifyUnsubscribeToken("secret", token)
+	require.NoError(t, err)
+	require.Equal(t, "investor@ditto.trade", email)
+	require.Equal(t, CategoryTradingAlerts, category)
+
+	_, _, err = VerifyUnsubscribeToken("other", token)
+	require.ErrorIs(t, err, ErrInvalidUnsubscribeToken)
+	_, _, err = VerifyUnsubscribeToken("", UnsubscribeToken("", "investor@ditto.trade", CategoryMarketing))
+	require.ErrorIs(t, err, ErrInvalidUnsubscribeToken)
+
+	// category of signed token cannot be replaced
+	forged := UnsubscribeToken("other", "investor@ditto.trade", CategorySecurity)
+	_, sig, _ := strings.Cut(token, ".")
+	payload, _, _ := strings.Cut(forged, ".")
+	_, _, err = VerifyUnsubscribeToken("secret", payload+"."+sig)
+	require.ErrorIs(t, err, ErrInvalidUnsubscribeToken)
+	for _, malformed := range []string{"", ".", "abc", "!!.!!", token + "x"} {
+		_, _, err = VerifyUnsubscribeToken("secret", malformed)
+		require.ErrorIs(t, err, ErrInvalidUnsubscribeToken, malformed)
+	}
+}
+
+func TestService_Preferences(t *testing.T) {
+	prefs := &memoryPreferences{}
+	outbox := NewOutbox()
+	cfg := testConfig
+	cfg.UnsubscribeURL = "https://ditto.trade/unsubscribe"
+	cfg.UnsubscribeSecret = "secret"
+	s := New(outbox, cfg, WithPreferences(prefs), WithTemplates(DefaultTemplates()))
+	ctx := context.TODO()
+
+	require.NoError(t, s.SendNotificationStopLoss(ctx, "investor@ditto.trade", "Alpha", uuid.New(), 900, 1000))
+	email, ok := outbox.AssertSent(t, StopLossTmpl, "investor@ditto.trade")
+	require.True(t, ok)
+	link, ok := email.TemplateModel["unsubscribe_url"].(string)
+	require.True(t, ok)
+	require.True(t, strings.HasPrefix(link, cfg.UnsubscribeURL+"?token="))
+	require.Contains(t, email.TextBody, "Unsubscribe from these notifications: "+link)
+
+	// security emails have no unsubscribe link
+	require.NoError(t, s.SendVerificationCode(ctx, "investor@ditto.trade", "111111"))
+	email, _ = outbox.AssertSent(t, VerificationCodeTmpl, "investor@ditto.trade")
+	require.Empty(t, email.TemplateModel["unsubscribe_url"])
+	require.NotContains(t, email.HTMLBody, "Unsubscribe")
+
+	parsed, err := url.Parse(link)
+	require.NoError(t, err)
+	require.NoError(t, s.Unsubscribe(ctx, parsed.Query().Get("token")))
+	outbox.Reset()
+
+	err = s.SendNotificationStopLoss(ctx, "Investor@ditto.trade", "Alpha", uuid.New(), 900, 1000)
+	require.ErrorIs(t, err, ErrOptedOut)
+	require.False(t, IsRetryable(err))
+	require.NoError(t, s.SendNotificationStopLoss(ctx, "investor@ditto.trade", "Alpha", uuid.New(), 900, 1000,
+		WithCritical()))
+	require.NoError(t, s.SendVerificationCode(ctx, "investor@ditto.trade", "111111"))
+	require.Equal(t, 2, outbox.Len())
+
+	// security emails cannot be opted out of
+	err = s.Unsubscribe(ctx, UnsubscribeToken("secret", "investor@ditto.trade", CategorySecurity))
+	require.ErrorIs(t, err, ErrInvalidUnsubscribeToken)
+}
+
+func TestService_UnsubscribeDisplayName(t *testing.T) {
+	prefs := &memoryPreferences{}
+	outbox := NewOutbox()
+	cfg := testConfig
+	cfg.UnsubscribeURL = "https://ditto.trade/unsubscribe"
+	cfg.UnsubscribeSecret = "secret"
+	s := New(outbox, cfg, WithPreferences(prefs))
+	ctx := context.TODO()
+
+	// token is signed for the bare address which preferences are checked for
+	require.NoError(t, s.SendNotificationStopLoss(ctx, "Bob <Bob@ditto.trade>", "Alpha", uuid.New(), 900, 1000))
+	email, ok := outbox.Last()
+	require.True(t, ok)
+	parsed, err := url.Parse(email.TemplateModel["unsubscribe_url"].(string))
+	require.NoError(t, err)
+	address, category, err := VerifyUnsubscribeToken("secret", parsed.Query().Get("token"))
+	require.NoError(t, err)
+	require.Equal(t, "bob@ditto.trade", address)
+	require.Equal(t, CategoryTradingAlerts, category)
+	require.NoError(t, s.Unsubscribe(ctx, parsed.Query().Get("token")))
+
+	for _, to := range []string{"Bob <bob@ditto.trade>", "bob@ditto.trade"} {
+		err = s.SendNotificationStopLoss(ctx, to, "Alpha", uuid.New(), 900, 1000)
+		require.ErrorIs(t, err, ErrOptedOut)
+	}
+	require.Equal(t, 1, outbox.Len())
+}
+
+func TestConfig_ValidateUnsubscribe(t *testing.T) {
+	cfg := testConfig
+	cfg.UnsubscribeURL = "/unsubscribe?x=1"
+	err := cfg.Validate()
+	require.ErrorIs(t, err, ErrInvalidConfig)
+	require.Contains(t, err.Error(), "UnsubscribeURL")
+	require.Contains(t, err.Error(), "UnsubscribeSecret is required")
+}
+
+func TestPostgresPreferences(t *testing.T) {
+	database := openTestDB(t)
+	ctx := context.TODO()
+	require.NoError(t, CreatePreferencesTable(ctx, database))
+	prefs := NewPostgresPreferences(database)
+	email := "prefs-" + uuid.NewString() + "@ditto.trade"
+	defer func() {
+		_, _ = database.ExecContext(ctx, "DELETE FROM mail_preferences WHERE email = $1", email)
+	}()
+
+	optedOut, err := prefs.OptedOut(ctx, email, CategoryMarketing)
+	require.NoError(t, err)
+	require.False(t, optedOut)
+
+	require.NoError(t, prefs.SetOptedOut(ctx, strings.ToUpper(email), CategoryMarketing, true))
+	require.NoError(t, prefs.SetOptedOut(ctx, email, CategoryReports, true))
+	require.NoError(t, prefs.SetOptedOut(ctx, email, CategoryReports, false))
+	optedOut, err = prefs.OptedOut(ctx, email, CategoryMarketing)
+	require.NoError(t, err)
+	require.True(t, optedOut)
+
+	all, err := prefs.Preferences(ctx, email)
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{CategoryMarketing: true, CategoryReports: false}, all)
+}
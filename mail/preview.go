@@ -0,0 +1,108 @@
+package mail
+
+import (
+	"fmt"
+
+	"github.com/dittotrade/internal/utils"
+	"github.com/google/uuid"
+)
+
+// PreviewRecipient receives emails composed by Service.Preview
+const PreviewRecipient = "investor@example.com"
+
+var sampleStrategyID = uuid.MustParse("6f1c9a6e-2b4d-4c1e-9a53-0d3c2f8b7e41")
+
+// SampleModels are realistic models of predefined templates,
+// they are used by Service.Preview checks and cmd/mailpreview
+var SampleModels = map[string]interface{}{
+	VerificationCodeTmpl:   OTPModel{OTP: "493027"},
+	PasswordResetTmpl:      OTPModel{OTP: "493027"},
+	DestroyAccountCodeTmpl: OTPModel{OTP: "493027"},
+	StopLossTmpl: StopLossModel{StrategyName: "Momentum FX", StrategyID: sampleStrategyID,
+		Equity: 8950.25, StopLoss: 9000},
+	StopLossDigestTmpl: StopLossDigestModel{Count: 2, Notifications: []map[string]interface{}{
+		{"strategy_name": "Momentum FX", "strategy_id": sampleStrategyID,
+			"equity_formatted": "8,950.25", "stop_loss_formatted": "9,000.00"},
+		{"strategy_name": "Gold Swing", "strategy_id": sampleStrategyID,
+			"equity_formatted": "1,204.10", "stop_loss_formatted": "1,250.00"},
+	}},
+	TakeProfitTmpl: TakeProfitModel{StrategyName: "Momentum FX", StrategyID: sampleStrategyID,
+		Equity: 12100.5, TakeProfit: 12000},
+	MarginCallTmpl: MarginCallModel{InvestmentAccountID: sampleStrategyID, Equity: 2430.75, MarginLevel: 85.5},
+	DrawdownTmpl: DrawdownModel{StrategyName: "Momentum FX", StrategyID: sampleStrategyID,
+		Drawdown: 21.4, Threshold: 20},
+	DepositTmpl:    TransactionModel{TransactionID: sampleStrategyID, Amount: 5000, Currency: "USD"},
+	WithdrawalTmpl: TransactionModel{TransactionID: sampleStrategyID, Amount: 1250.5, Currency: "EUR"},
+	CopyStartedTmpl: CopyStartedModel{StrategyName: "Momentum FX", StrategyID: sampleStrategyID,
+		Amount: 10000},
+	CopyStoppedTmpl: CopyStoppedModel{StrategyName: "Momentum FX", StrategyID: sampleStrategyID,
+		Equity: 10432.8},
+	StrategyPausedTmpl: StrategyPausedModel{StrategyName: "Momentum FX", StrategyID: sampleStrategyID,
+		Reason: "the trader paused trading for maintenance"},
+}
+
+// TemplateReport is a result of checking local template against model
+type TemplateReport struct {
+	// Template is the checked template alias, localized one if locale is given
+	Template string
+	// Missing are variables used by template which neither model nor Config defaults provide
+	Missing []string
+	// Unused are model variables which template uses neither directly nor as <name>_formatted
+	Unused []string
+}
+
+// OK reports whether template renders with the model
+func (r TemplateReport) OK() bool {
+	return len(r.Missing) == 0
+}
+
+// Preview composes email of local template tpl with model to PreviewRecipient without sending it.
+// Email is empty when report has missing variables.
+// Only WithLocale and WithBrand options apply.
+func (s *Service) Preview(tpl string, model interface{}, opts ...SendOption) (Email, TemplateReport, error) {
+	o := s.sendOptions(opts)
+	data, err := templateModel(model)
+	if err != nil {
+		return Email{}, TemplateReport{}, fmt.Errorf("could not preview %s: %w", tpl, err)
+	}
+	locale := s.resolveLocale(o.locale)
+	alias := s.localizedTemplate(tpl, locale)
+	if s.templates == nil || !s.templates.Has(alias) {
+		return Email{}, TemplateReport{}, fmt.Errorf("could not preview %s: %w: %s", tpl, ErrTemplateNotFound, alias)
+	}
+	if _, ok := s.config.Brands[o.brand]; o.brand != "" && !ok {
+		return Email{}, TemplateReport{}, fmt.Errorf("could not preview %s: %w %q", tpl, ErrUnknownBrand, o.brand)
+	}
+
+	payload := s.payload(tpl, PreviewRecipient, PreviewRecipient, data, locale,
+		localizedConfig(s.brandConfig(o.brand), locale))
+	vars := make(map[string]bool)
+	report := TemplateReport{Template: alias}
+	for _, v := range s.templates.Vars(alias) {
+		vars[v] = true
+		if _, ok := payload[v]; !ok {
+			report.Missing = append(report.Missing, v)
+		}
+	}
+	for _, k := range sortedKeys(keySet(data)) {
+		if !vars[k] && !vars[utils.Underscore(k)+"_formatted"] {
+			report.Unused = append(report.Unused, k)
+		}
+	}
+	if !report.OK() {
+		return Email{}, report, nil
+	}
+	email, err := s.compose(tpl, "preview", PreviewRecipient, PreviewRecipient, data, o)
+	if err != nil {
+		return Email{}, report, fmt.Errorf("could not preview %s: %w", tpl, err)
+	}
+	return email, report, nil
+}
+
+func keySet(m map[string]interface{}) map[string]bool {
+	res := make(map[string]bool, len(m))
+	for k := range m {
+		res[k] = true
+	}
+	return res
+}
@@ -0,0 +1,55 @@
+package mail
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestSampleModels checks that models of predefined templates match variables used by local templates
+func TestSampleModels(t *testing.T) {
+	templates := DefaultTemplates()
+	s := New(NewOutbox(), testConfig, WithTemplates(templates))
+	for _, alias := range templates.Aliases() {
+		model, ok := SampleModels[alias]
+		require.True(t, ok, "no sample model of %s", alias)
+		email, report, err := s.Preview(alias, model)
+		require.NoError(t, err, alias)
+		require.Empty(t, report.Missing, alias)
+		require.Empty(t, report.Unused, alias)
+		require.NotEmpty(t, email.Subject, alias)
+		require.NotEmpty(t, email.HTMLBody, alias)
+		require.NotEmpty(t, email.TextBody, alias)
+	}
+	for alias := range SampleModels {
+		require.True(t, templates.Has(alias), "no template of sample model %s", alias)
+	}
+}
+
+func TestService_Preview(t *testing.T) {
+	templates, err := LoadTemplates(fstest.MapFS{
+		"stop_loss/subject.txt": {Data: []byte("Stop loss {{.strategy}}")},
+		"stop_loss/body.html":   {Data: []byte("<p>{{.equity_formatted}} {{.product_name}}</p>")},
+	})
+	require.NoError(t, err)
+	s := New(NewOutbox(), testConfig, WithTemplates(templates))
+
+	email, report, err := s.Preview(StopLossTmpl, SampleModels[StopLossTmpl])
+	require.NoError(t, err)
+	require.False(t, report.OK())
+	require.Equal(t, []string{"strategy"}, report.Missing)
+	require.Equal(t, []string{"stopLoss", "strategy_id", "strategy_name"}, report.Unused)
+	require.Empty(t, email.HTMLBody)
+
+	email, report, err = s.Preview(StopLossTmpl, map[string]interface{}{"strategy": "Alpha", "equity": 1.5})
+	require.NoError(t, err)
+	require.True(t, report.OK())
+	require.Empty(t, report.Unused)
+	require.Equal(t, "Stop loss Alpha", email.Subject)
+	require.Equal(t, "<p>1.50 Ditto Trade</p>", email.HTMLBody)
+	require.Equal(t, PreviewRecipient, email.To)
+
+	_, _, err = s.Preview(TakeProfitTmpl, SampleModels[TakeProfitTmpl])
+	require.ErrorIs(t, err, ErrTemplateNotFound)
+}
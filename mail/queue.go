@@ -0,0 +1,395 @@
+package mail
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dittotrade/internal/db"
+	"github.com/dittotrade/internal/utils"
+	"github.com/google/uuid"
+)
+
+// QueueSchema creates table used by Enqueue, Service.SendAt and Dispatcher
+const QueueSchema = `
+create table if not exists mail_queue (
+	id              bigserial primary key,
+	template        text not null,
+	tag             text not null,
+	recipient       text not null,
+	locale          text not null default '',
+	brand           text not null default '',
+	critical        boolean not null default false,
+	metadata        jsonb not null default '{}',
+	model           jsonb not null default '{}',
+	digest          text not null default '',
+	status          text not null default 'pending',
+	attempts        int not null default 0,
+	next_attempt_at timestamptz not null default now(),
+	message_id      text,
+	last_error      text,
+	created_at      timestamptz not null default now(),
+	sent_at         timestamptz
+);
+create index if not exists mail_queue_pending_idx on mail_queue (next_attempt_at) where status = 'pending';
+create index if not exists mail_queue_digest_idx on mail_queue (digest) where status = 'pending' and digest <> '';
+`
+
+// Queued email statuses
+const (
+	QueueStatusPending = "pending"
+	QueueStatusSent    = "sent"
+	QueueStatusFailed  = "failed"
+	// QueueStatusCancelled is a status of email cancelled by CancelQueued
+	QueueStatusCancelled = "cancelled"
+)
+
+// ErrNotPending is returned by CancelQueued when email is already sent, failed or cancelled
+var ErrNotPending = errors.New("queued email is not pending")
+
+// DefaultDispatchRetry is Retry of Dispatcher created by NewDispatcher
+var DefaultDispatchRetry = RetryPolicy{
+	MaxAttempts:    10,
+	InitialBackoff: 30 * time.Second,
+	MaxBackoff:     time.Hour,
+}
+
+type (
+	// QueuedEmail is an email waiting in mail_queue.
+	// Model is a struct or map as in Service.Send, it is merged with Config defaults when the email is dispatched.
+	// Model is stored as is until then, so it must not contain secrets such as OTP codes.
+	QueuedEmail struct {
+		Template string
+		Tag      string
+		To       string
+		// Locale of recipient, see WithLocale
+		Locale string
+		// Brand of email, see WithBrand
+		Brand string
+		// Critical email is sent despite suppressions and opt-outs, see WithCritical
+		Critical bool
+		// Metadata is attached to email, see WithMetadata
+		Metadata map[string]string
+		// At delays email until the time, zero time dispatches it immediately
+		At    time.Time
+		Model interface{}
+	}
+
+	// Dispatcher sends emails from mail_queue through Service when they are due.
+	// Rows are claimed with SKIP LOCKED, so dispatchers without LockTable may run concurrently.
+	Dispatcher struct {
+		database *sql.DB
+		service  *Service
+		// BatchSize is the number of emails claimed at once
+		BatchSize int
+		// PollInterval is a pause when the queue is empty
+		PollInterval time.Duration
+		// Lease postpones claimed emails so they are retried if the dispatcher dies while sending
+		Lease time.Duration
+		// Retry defines backoff between attempts, email fails after Retry.MaxAttempts
+		Retry RetryPolicy
+		// LockTable is a table of db.GetDBLock which elects the only running dispatcher,
+		// dispatchers run concurrently when it is empty
+		LockTable string
+		// LockInterval is a lease of the lock, it is refreshed before each email
+		LockInterval time.Duration
+	}
+)
+
+// CreateQueueTable creates mail_queue table if it does not exist
+func CreateQueueTable(ctx context.Context, dbtx db.DBTX) error {
+	if _, err := dbtx.ExecContext(ctx, QueueSchema); err != nil {
+		return fmt.Errorf("could not create mail_queue: %w", err)
+	}
+	return nil
+}
+
+// Enqueue stores email in mail_queue and returns its id, the email is dispatched at email.At or immediately.
+// Call it inside db.Transaction to commit the email atomically with business changes.
+func Enqueue(ctx context.Context, dbtx db.DBTX, email QueuedEmail) (id int64, err error) {
+	data, err := templateModel(email.Model)
+	if err != nil {
+		return 0, fmt.Errorf("could not enqueue email: %w", err)
+	}
+	if err = checkMetadata(email.Metadata); err != nil {
+		return 0, fmt.Errorf("could not enqueue email: %w", err)
+	}
+	model, err := json.Marshal(data)
+	if err != nil {
+		return 0, fmt.Errorf("could not encode model: %w", err)
+	}
+	metadata, err := json.Marshal(email.Metadata)
+	if err != nil {
+		return 0, fmt.Errorf("could not encode metadata: %w", err)
+	}
+	err = dbtx.QueryRowContext(ctx, `INSERT INTO mail_queue(template, tag, recipient, locale, brand, critical,
+		metadata, model, next_attempt_at) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,coalesce($9, now())) RETURNING id`,
+		email.Template, email.Tag, email.To, email.Locale, email.Brand, email.Critical, metadata, model,
+		nullTime(email.At)).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("could not enqueue email: %w", err)
+	}
+	return id, nil
+}
+
+// CancelQueued cancels pending email, e.g. a reminder which is not relevant anymore
+func CancelQueued(ctx context.Context, dbtx db.DBTX, id int64) error {
+	res, err := dbtx.ExecContext(ctx, `UPDATE mail_queue SET status = $2 WHERE id = $1 AND status = 'pending'`,
+		id, QueueStatusCancelled)
+	if err != nil {
+		return fmt.Errorf("could not cancel queued email %d: %w", id, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not cancel queued email %d: %w", id, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("could not cancel queued email %d: %w", id, ErrNotPending)
+	}
+	return nil
+}
+
+// options returns SendOption of stored email, id as idempotency key prevents duplicates
+// if the dispatcher dies after sending
+func (e QueuedEmail) options(id int64) []SendOption {
+	opts := []SendOption{WithLocale(e.Locale), WithBrand(e.Brand),
+		WithIdempotencyKey(fmt.Sprintf("mail_queue:%d", id))}
+	if e.Critical {
+		opts = append(opts, WithCritical())
+	}
+	for k, v := range e.Metadata {
+		opts = append(opts, WithMetadata(k, v))
+	}
+	return opts
+}
+
+// EnqueueNotificationStopLoss is a queued version of Service.SendNotificationStopLoss
+func EnqueueNotificationStopLoss(ctx context.Context, dbtx db.DBTX, email, strategyName string, strategyID uuid.UUID,
+	currentEquity, stopLoss float64) error {
+	if _, err := Enqueue(ctx, dbtx, QueuedEmail{
+		Template: StopLossTmpl,
+		Tag:      stopLossTag,
+		To:       email,
+		Model: StopLossModel{
+			StrategyName: strategyName,
+			StrategyID:   strategyID,
+			Equity:       currentEquity,
+			StopLoss:     stopLoss,
+		},
+	}); err != nil {
+		return fmt.Errorf("could not enqueue stop loss notification: %w", err)
+	}
+	return nil
+}
+
+// NewDispatcher creates Dispatcher with default settings
+func NewDispatcher(database *sql.DB, service *Service) *Dispatcher {
+	return &Dispatcher{
+		database:     database,
+		service:      service,
+		BatchSize:    20,
+		PollInterval: 5 * time.Second,
+		Lease:        5 * time.Minute,
+		Retry:        DefaultDispatchRetry,
+		LockTable:    "mail_queue_lock",
+		LockInterval: 2 * time.Minute,
+	}
+}
+
+// Run dispatches emails until ctx is cancelled, replicas which do not hold the lock wait for it
+func (d *Dispatcher) Run(ctx context.Context) error {
+	for {
+		if err := d.runLocked(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("mail dispatcher: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d.PollInterval):
+		}
+	}
+}
+
+// runLocked dispatches emails while the lock is held, it returns nil when the lock is held by another replica
+func (d *Dispatcher) runLocked(ctx context.Context) error {
+	holdLock, releaseLock := func() error { return nil }, func() error { return nil }
+	if d.LockTable != "" {
+		holdLock, releaseLock = db.GetDBLock(ctx, d.database, d.LockTable, d.LockInterval)
+	}
+	defer func() {
+		if err := releaseLock(); err != nil {
+			log.Printf("mail dispatcher: %s", err)
+		}
+	}()
+	for {
+		n, err := d.dispatch(ctx, holdLock)
+		if errors.Is(err, db.ErrLockRefused) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d.PollInterval):
+		}
+	}
+}
+
+type queueRow struct {
+	id       int64
+	attempts int
+	email    QueuedEmail
+	model    map[string]interface{}
+	// digest groups notifications sent as one email, see Service.addToDigest
+	digest string
+}
+
+// queueColumns are scanned by scanQueueRows
+const queueColumns = `id, attempts, template, tag, recipient, locale, brand, critical, metadata, model, digest`
+
+// DispatchOnce claims a batch of due emails, sends them and records results.
+// It returns the number of processed emails. Unlike Run it does not take the lock.
+func (d *Dispatcher) DispatchOnce(ctx context.Context) (int, error) {
+	return d.dispatch(ctx, func() error { return nil })
+}
+
+// dispatch checks that the lock is still held before sending each email
+func (d *Dispatcher) dispatch(ctx context.Context, holdLock func() error) (int, error) {
+	if err := holdLock(); err != nil {
+		return 0, err
+	}
+	rows, err := d.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+	groups, err := d.groupDigests(ctx, rows)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, g := range groups {
+		if err = holdLock(); err != nil {
+			// claimed emails are retried when the lease expires
+			return n, err
+		}
+		var res Response
+		var sendErr error
+		if g[0].digest != "" {
+			res, sendErr = d.service.sendDigest(ctx, g)
+		} else {
+			res, sendErr = d.service.send(ctx, g[0].email.Template, g[0].email.Tag, g[0].email.To, g[0].model,
+				g[0].email.options(g[0].id)...)
+		}
+		if ctx.Err() != nil {
+			return n, ctx.Err()
+		}
+		for _, r := range g {
+			if err = d.complete(ctx, r, res, sendErr); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// claim locks due emails by moving next_attempt_at forward by Lease
+func (d *Dispatcher) claim(ctx context.Context) ([]queueRow, error) {
+	rows, err := d.database.QueryContext(ctx, `UPDATE mail_queue SET attempts = attempts + 1,
+		next_attempt_at = now() + $2::bigint * interval '1 millisecond'
+		WHERE id IN (
+			SELECT id FROM mail_queue WHERE status = 'pending' AND next_attempt_at <= now()
+			ORDER BY next_attempt_at LIMIT $1 FOR UPDATE SKIP LOCKED)
+		RETURNING `+queueColumns, d.BatchSize, d.Lease.Milliseconds())
+	if err != nil {
+		return nil, fmt.Errorf("could not claim queued emails: %w", err)
+	}
+	return scanQueueRows(rows)
+}
+
+// groupDigests groups notifications of the same digest, other emails are groups of one.
+// Due notifications of a digest which did not fit into BatchSize are claimed too.
+func (d *Dispatcher) groupDigests(ctx context.Context, rows []queueRow) ([][]queueRow, error) {
+	var groups [][]queueRow
+	digests := make(map[string]int)
+	for _, r := range rows {
+		if r.digest == "" {
+			groups = append(groups, []queueRow{r})
+			continue
+		}
+		if i, ok := digests[r.digest]; ok {
+			groups[i] = append(groups[i], r)
+			continue
+		}
+		digests[r.digest] = len(groups)
+		groups = append(groups, []queueRow{r})
+	}
+	for digest, i := range digests {
+		rows, err := d.database.QueryContext(ctx, `UPDATE mail_queue SET attempts = attempts + 1,
+			next_attempt_at = now() + $2::bigint * interval '1 millisecond'
+			WHERE status = 'pending' AND digest = $1 AND next_attempt_at <= now()
+			RETURNING `+queueColumns, digest, d.Lease.Milliseconds())
+		if err != nil {
+			return nil, fmt.Errorf("could not claim digest: %w", err)
+		}
+		rest, err := scanQueueRows(rows)
+		if err != nil {
+			return nil, err
+		}
+		groups[i] = append(groups[i], rest...)
+	}
+	return groups, nil
+}
+
+// scanQueueRows reads and closes rows of queueColumns
+func scanQueueRows(rows *sql.Rows) (res []queueRow, err error) {
+	defer utils.CloseOrErr(rows, &err)
+	for rows.Next() {
+		var r queueRow
+		var metadata, model []byte
+		if err = rows.Scan(&r.id, &r.attempts, &r.email.Template, &r.email.Tag, &r.email.To, &r.email.Locale,
+			&r.email.Brand, &r.email.Critical, &metadata, &model, &r.digest); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(metadata, &r.email.Metadata); err != nil {
+			return nil, fmt.Errorf("could not decode metadata of queued email %d: %w", r.id, err)
+		}
+		if err = json.Unmarshal(model, &r.model); err != nil {
+			return nil, fmt.Errorf("could not decode model of queued email %d: %w", r.id, err)
+		}
+		r.email.Model = r.model
+		res = append(res, r)
+	}
+	return res, rows.Err()
+}
+
+// complete records result of sending, failed email is rescheduled with backoff while it is retryable
+func (d *Dispatcher) complete(ctx context.Context, r queueRow, res Response, sendErr error) error {
+	var err error
+	switch {
+	case sendErr == nil:
+		_, err = d.database.ExecContext(ctx, `UPDATE mail_queue SET status = $2, message_id = $3, sent_at = now(),
+			last_error = NULL WHERE id = $1`, r.id, QueueStatusSent, res.MessageID)
+	case IsRetryable(sendErr) && r.attempts < d.Retry.MaxAttempts:
+		_, err = d.database.ExecContext(ctx, `UPDATE mail_queue SET last_error = $2,
+			next_attempt_at = now() + $3::bigint * interval '1 millisecond' WHERE id = $1`,
+			r.id, sendErr.Error(), d.Retry.Backoff(r.attempts).Milliseconds())
+	default:
+		log.Printf("mail dispatcher: email %d to %s failed after %d attempts: %s", r.id, r.email.To, r.attempts, sendErr)
+		_, err = d.database.ExecContext(ctx, `UPDATE mail_queue SET status = $2, last_error = $3 WHERE id = $1`,
+			r.id, QueueStatusFailed, sendErr.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("could not update queued email %d: %w", r.id, err)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package mail
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/dittotrade/internal/db"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	dbUrl := os.Getenv("DATABASE_URL")
+	if dbUrl == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+	database, err := sql.Open("postgres", dbUrl)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = database.Close() })
+	return database
+}
+
+func TestDispatcher(t *testing.T) {
+	database := openTestDB(t)
+	ctx := context.TODO()
+	require.NoError(t, CreateQueueTable(ctx, database))
+
+	recipient := "queue-" + uuid.NewString() + "@ditto.trade"
+	defer func() {
+		_, _ = database.ExecContext(ctx, "DELETE FROM mail_queue WHERE recipient = $1", recipient)
+	}()
+	err := db.Transaction(database)(func(tx db.DBTX) error {
+		return EnqueueNotificationStopLoss(ctx, tx, recipient, "Alpha", uuid.New(), 900, 1000)
+	})
+	require.NoError(t, err)
+
+	outbox := NewOutbox()
+	d := NewDispatcher(database, New(outbox, testConfig))
+	d.BatchSize = 1000
+	_, err = d.DispatchOnce(ctx)
+	require.NoError(t, err)
+	email, ok := outbox.AssertSent(t, StopLossTmpl, recipient)
+	require.True(t, ok)
+	AssertModel(t, email, "strategy_name", "Alpha")
+
+	var status string
+	var messageID sql.NullString
+	require.NoError(t, database.QueryRowContext(ctx, "SELECT status, message_id FROM mail_queue WHERE recipient = $1",
+		recipient).Scan(&status, &messageID))
+	require.Equal(t, QueueStatusSent, status)
+	require.True(t, messageID.Valid)
+}
@@ -0,0 +1,186 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dittotrade/internal/db"
+)
+
+// RateLimitSchema creates table used by PostgresRateLimiter
+const RateLimitSchema = `
+create table if not exists mail_rate_limits (
+	key          text primary key,
+	window_start timestamptz not null,
+	count        int not null
+);
+`
+
+// DefaultRateLimits are used when Config.RateLimits is nil.
+// They protect users from OTP emails triggered by anyone who knows their address.
+var DefaultRateLimits = map[string]RateLimit{
+	VerificationCodeTmpl:   {Max: 5, Window: time.Hour},
+	PasswordResetTmpl:      {Max: 5, Window: time.Hour},
+	DestroyAccountCodeTmpl: {Max: 5, Window: time.Hour},
+}
+
+type (
+	// RateLimit allows Max emails of a template to a recipient per Window
+	RateLimit struct {
+		Max    int
+		Window time.Duration
+	}
+
+	// RateLimiter counts emails by key, it returns positive retryAfter when limit is exceeded
+	RateLimiter interface {
+		Allow(ctx context.Context, key string, limit RateLimit) (retryAfter time.Duration, err error)
+	}
+
+	// RateLimitError is returned when recipient exceeded RateLimit of template, it matches ErrRateLimited
+	RateLimitError struct {
+		Template   string
+		To         string
+		RetryAfter time.Duration
+	}
+
+	// MemoryRateLimiter is in-process RateLimiter with sliding window
+	MemoryRateLimiter struct {
+		mu        sync.Mutex
+		buckets   map[string]*rateBucket
+		lastSweep time.Time
+		now       func() time.Time
+	}
+
+	// rateBucket holds send times of a key within window
+	rateBucket struct {
+		sent   []time.Time
+		window time.Duration
+	}
+
+	// PostgresRateLimiter is RateLimiter with fixed window shared by replicas via mail_rate_limits table
+	PostgresRateLimiter struct {
+		dbtx db.DBTX
+	}
+)
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s: too many %s emails to %s, retry after %s", ErrRateLimited, e.Template, e.To,
+		e.RetryAfter.Round(time.Second))
+}
+
+// Is matches ErrRateLimited
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// NewMemoryRateLimiter creates in-process RateLimiter
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{buckets: make(map[string]*rateBucket), now: time.Now}
+}
+
+// Allow records email if limit is not exceeded, otherwise returns time until the oldest email leaves the window
+func (l *MemoryRateLimiter) Allow(_ context.Context, key string, limit RateLimit) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.lastSweep) > time.Minute {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{}
+		l.buckets[key] = b
+	}
+	b.window = limit.Window
+	for len(b.sent) > 0 && now.Sub(b.sent[0]) >= b.window {
+		b.sent = b.sent[1:]
+	}
+	if len(b.sent) >= limit.Max {
+		return b.sent[0].Add(b.window).Sub(now), nil
+	}
+	b.sent = append(b.sent, now)
+	return 0, nil
+}
+
+// sweep drops keys without emails in window, so addresses tried once do not stay in memory forever
+func (l *MemoryRateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if len(b.sent) == 0 || now.Sub(b.sent[len(b.sent)-1]) >= b.window {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// CreateRateLimitTable creates mail_rate_limits table if it does not exist
+func CreateRateLimitTable(ctx context.Context, dbtx db.DBTX) error {
+	if _, err := dbtx.ExecContext(ctx, RateLimitSchema); err != nil {
+		return fmt.Errorf("could not create mail_rate_limits: %w", err)
+	}
+	return nil
+}
+
+// NewPostgresRateLimiter creates RateLimiter shared by all replicas using the database
+func NewPostgresRateLimiter(dbtx db.DBTX) *PostgresRateLimiter {
+	return &PostgresRateLimiter{dbtx: dbtx}
+}
+
+// Allow increments counter of key, the counter restarts when its window expires
+func (l *PostgresRateLimiter) Allow(ctx context.Context, key string, limit RateLimit) (time.Duration, error) {
+	var count int
+	var retryAfter int64
+	err := l.dbtx.QueryRowContext(ctx, `INSERT INTO mail_rate_limits AS l (key, window_start, count)
+		VALUES ($1, now(), 1)
+		ON CONFLICT (key) DO UPDATE SET
+			count = CASE WHEN l.window_start <= now() - $2::bigint * interval '1 millisecond'
+				THEN 1 ELSE l.count + 1 END,
+			window_start = CASE WHEN l.window_start <= now() - $2::bigint * interval '1 millisecond'
+				THEN now() ELSE l.window_start END
+		RETURNING count,
+			(extract(epoch from l.window_start + $2::bigint * interval '1 millisecond' - now()) * 1000)::bigint`,
+		key, limit.Window.Milliseconds()).Scan(&count, &retryAfter)
+	if err != nil {
+		return 0, fmt.Errorf("could not count emails of %s: %w", key, err)
+	}
+	if count <= limit.Max {
+		return 0, nil
+	}
+	return time.Duration(retryAfter) * time.Millisecond, nil
+}
+
+// Cleanup deletes counters of windows started before olderThan ago
+func (l *PostgresRateLimiter) Cleanup(ctx context.Context, olderThan time.Duration) error {
+	if _, err := l.dbtx.ExecContext(ctx, `DELETE FROM mail_rate_limits
+		WHERE window_start < now() - $1::bigint * interval '1 millisecond'`, olderThan.Milliseconds()); err != nil {
+		return fmt.Errorf("could not clean up mail_rate_limits: %w", err)
+	}
+	return nil
+}
+
+// rateLimit returns configured limit of template
+func (s *Service) rateLimit(tpl string) (RateLimit, bool) {
+	limits := s.config.RateLimits
+	if limits == nil {
+		limits = DefaultRateLimits
+	}
+	limit, ok := limits[tpl]
+	return limit, ok && limit.Max > 0 && limit.Window > 0
+}
+
+// checkRateLimit returns *RateLimitError if recipient received too many emails of template
+func (s *Service) checkRateLimit(ctx context.Context, tpl, email string) error {
+	limit, ok := s.rateLimit(tpl)
+	if !ok || s.limiter == nil {
+		return nil
+	}
+	retryAfter, err := s.limiter.Allow(ctx, tpl+":"+normalizeEmail(email), limit)
+	if err != nil {
+		return err
+	}
+	if retryAfter > 0 {
+		return &RateLimitError{Template: tpl, To: email, RetryAfter: retryAfter}
+	}
+	return nil
+}
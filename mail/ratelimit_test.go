@@ -0,0 +1,77 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryRateLimiter(t *testing.T) {
+	l := NewMemoryRateLimiter()
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	limit := RateLimit{Max: 2, Window: time.Hour}
+	ctx := context.TODO()
+
+	for i := 0; i < 2; i++ {
+		retryAfter, err := l.Allow(ctx, "a", limit)
+		require.NoError(t, err)
+		require.Zero(t, retryAfter)
+		now = now.Add(10 * time.Minute)
+	}
+	retryAfter, err := l.Allow(ctx, "a", limit)
+	require.NoError(t, err)
+	require.Equal(t, 40*time.Minute, retryAfter)
+
+	retryAfter, _ = l.Allow(ctx, "b", limit)
+	require.Zero(t, retryAfter, "limits are per key")
+
+	now = now.Add(40 * time.Minute)
+	retryAfter, _ = l.Allow(ctx, "a", limit)
+	require.Zero(t, retryAfter)
+}
+
+func TestService_RateLimit(t *testing.T) {
+	outbox := NewOutbox()
+	cfg := testConfig
+	cfg.RateLimits = map[string]RateLimit{VerificationCodeTmpl: {Max: 2, Window: time.Hour}}
+	s := New(outbox, cfg)
+	ctx := context.TODO()
+
+	require.NoError(t, s.SendVerificationCode(ctx, "user01@ditto.trade", "111111"))
+	require.NoError(t, s.SendVerificationCode(ctx, "User01@ditto.trade", "222222"))
+	err := s.SendVerificationCode(ctx, "user01@ditto.trade", "333333")
+	require.ErrorIs(t, err, ErrRateLimited)
+	var rateErr *RateLimitError
+	require.True(t, errors.As(err, &rateErr))
+	require.Greater(t, rateErr.RetryAfter, 59*time.Minute)
+	require.Equal(t, 2, outbox.Len())
+
+	// other templates are not limited
+	require.NoError(t, s.SendResetPasswordCode(ctx, "user01@ditto.trade", "444444"))
+}
+
+func TestPostgresRateLimiter(t *testing.T) {
+	database := openTestDB(t)
+	ctx := context.TODO()
+	require.NoError(t, CreateRateLimitTable(ctx, database))
+	l := NewPostgresRateLimiter(database)
+	key := "test:" + uuid.NewString()
+	defer func() {
+		_, _ = database.ExecContext(ctx, "DELETE FROM mail_rate_limits WHERE key = $1", key)
+	}()
+
+	limit := RateLimit{Max: 2, Window: time.Hour}
+	for i := 0; i < 2; i++ {
+		retryAfter, err := l.Allow(ctx, key, limit)
+		require.NoError(t, err)
+		require.Zero(t, retryAfter)
+	}
+	retryAfter, err := l.Allow(ctx, key, limit)
+	require.NoError(t, err)
+	require.Greater(t, retryAfter, 59*time.Minute)
+}
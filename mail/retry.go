@@ -0,0 +1,65 @@
+package mail
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy configures bounded exponential retry of transient failures
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, 1 disables retries
+	MaxAttempts int
+	// InitialBackoff is a delay before the second attempt, it doubles with each attempt
+	InitialBackoff time.Duration
+	// MaxBackoff limits the delay between attempts
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is used when Config.Retry is not set
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 200 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+}
+
+// Backoff returns randomized delay after failed attempt (starting from 1)
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < attempt && (p.MaxBackoff == 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	// jitter spreads retries of concurrent senders: [d/2, d)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retry calls fn until it succeeds, returns not retryable error or attempts are exhausted
+func (p RetryPolicy) retry(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxAttempts || !IsRetryable(err) {
+			return err
+		}
+		timer := time.NewTimer(p.Backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return wrapContextError(ctx, err)
+		case <-timer.C:
+		}
+	}
+}
+
+// retryPolicy returns configured policy or DefaultRetryPolicy
+func (s *Service) retryPolicy() RetryPolicy {
+	if s.config.Retry.MaxAttempts == 0 {
+		return DefaultRetryPolicy
+	}
+	return s.config.Retry
+}
@@ -0,0 +1,55 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// flakyTransport fails with errs one by one before succeeding
+type flakyTransport struct {
+	errs  []error
+	calls int
+}
+
+func (t *flakyTransport) Send(_ context.Context, email Email) (Response, error) {
+	t.calls++
+	if len(t.errs) > 0 {
+		err := t.errs[0]
+		t.errs = t.errs[1:]
+		return Response{}, err
+	}
+	return Response{To: email.To}, nil
+}
+
+func TestService_Retry(t *testing.T) {
+	cfg := testConfig
+	cfg.Retry = RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	transient := &SendError{Kind: ErrTransient, Err: errors.New("503")}
+
+	tr := &flakyTransport{errs: []error{transient, transient}}
+	require.NoError(t, New(tr, cfg).SendVerificationCode(context.TODO(), "user01@ditto.trade", "111111"))
+	require.Equal(t, 3, tr.calls)
+
+	tr = &flakyTransport{errs: []error{transient, transient, transient}}
+	err := New(tr, cfg).SendVerificationCode(context.TODO(), "user01@ditto.trade", "111111")
+	require.ErrorIs(t, err, ErrTransient)
+	require.Equal(t, 3, tr.calls)
+
+	tr = &flakyTransport{errs: []error{&SendError{Kind: ErrInvalidRecipient, Err: errors.New("300")}}}
+	err = New(tr, cfg).SendVerificationCode(context.TODO(), "user01@ditto.trade", "111111")
+	require.ErrorIs(t, err, ErrInvalidRecipient)
+	require.Equal(t, 1, tr.calls)
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt, max := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 10: time.Second} {
+		d := p.Backoff(attempt)
+		require.GreaterOrEqual(t, d, max/2)
+		require.LessOrEqual(t, d, max)
+	}
+}
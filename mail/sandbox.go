@@ -0,0 +1,85 @@
+package mail
+
+import (
+	"log"
+	netmail "net/mail"
+	"strings"
+)
+
+// Sandbox modes which may be selected by SandboxConfig.Mode
+const (
+	// SandboxOff sends emails to everyone
+	SandboxOff = ""
+	// SandboxDrop silently drops emails to recipients outside of allowlist
+	SandboxDrop = "drop"
+	// SandboxLog logs and drops emails to recipients outside of allowlist
+	SandboxLog = "log"
+	// SandboxRewrite sends emails to recipients outside of allowlist to CatchAll
+	SandboxRewrite = "rewrite"
+)
+
+// SandboxConfig protects real customers from emails of staging and development services
+type SandboxConfig struct {
+	Mode string
+	// Allowlist of addresses ("qa@ditto.trade") and domains ("ditto.trade") which receive emails as is
+	Allowlist []string
+	// CatchAll receives rewritten emails, original recipient is in the subject
+	// of locally rendered emails and in "original_recipient" model variable
+	CatchAll string
+}
+
+// allowed reports whether address of email matches Allowlist, lists of recipients never match
+func (c SandboxConfig) allowed(email string) bool {
+	addr, err := netmail.ParseAddress(email)
+	if err != nil {
+		return false
+	}
+	email = normalizeEmail(addr.Address)
+	for _, a := range c.Allowlist {
+		a = normalizeEmail(a)
+		if strings.Contains(a, "@") && !strings.HasPrefix(a, "@") {
+			if email == a {
+				return true
+			}
+		} else if strings.HasSuffix(email, "@"+strings.TrimPrefix(a, "@")) {
+			return true
+		}
+	}
+	return false
+}
+
+// sandboxDrops reports whether email must not be sent at all
+func (s *Service) sandboxDrops(tpl, email string) bool {
+	sb := s.config.Sandbox
+	if (sb.Mode != SandboxDrop && sb.Mode != SandboxLog) || sb.allowed(email) {
+		return false
+	}
+	if sb.Mode == SandboxLog {
+		log.Printf("mail sandbox: %s to %s is not sent", tpl, email)
+	}
+	return true
+}
+
+// sandboxRewrite sends email to CatchAll preserving the original recipient
+func (s *Service) sandboxRewrite(msg *Email) {
+	sb := s.config.Sandbox
+	if sb.Mode != SandboxRewrite || sb.allowed(msg.To) {
+		return
+	}
+	msg.TemplateModel["original_recipient"] = msg.To
+	if msg.Subject != "" {
+		msg.Subject = "[" + msg.To + "] " + msg.Subject
+	}
+	msg.To = sb.CatchAll
+}
+
+// ProductionEnvironment is Config.Environment which keeps tags as is
+const ProductionEnvironment = "production"
+
+// tag prefixes tag with Config.Environment outside production
+func (s *Service) tag(tag string) string {
+	if s.config.Environment == "" || strings.EqualFold(s.config.Environment, ProductionEnvironment) || tag == "" {
+		return tag
+	}
+	return s.config.Environment + "-" + tag
+}
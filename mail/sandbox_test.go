@@ -0,0 +1,60 @@
+package mail
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_Sandbox(t *testing.T) {
+	ctx := context.TODO()
+	cfg := testConfig
+	cfg.Environment = "staging"
+	cfg.Sandbox = SandboxConfig{Mode: SandboxDrop, Allowlist: []string{"ditto.trade", "qa@example.com"}}
+	require.NoError(t, cfg.Validate())
+	outbox := NewOutbox()
+	s := New(outbox, cfg, WithTemplates(DefaultTemplates()))
+
+	require.NoError(t, s.SendVerificationCode(ctx, "dev@ditto.trade", "111111"))
+	require.NoError(t, s.SendVerificationCode(ctx, "QA@example.com", "111111"))
+	require.NoError(t, s.SendVerificationCode(ctx, "investor@example.com", "111111"))
+	require.NoError(t, s.SendVerificationCode(ctx, "investor@notditto.trade", "111111"))
+	require.NoError(t, s.SendVerificationCode(ctx, "Investor <investor@example.com>", "111111"))
+	require.Equal(t, 2, outbox.Len())
+	// list of recipients cannot pass allowlist by its last address
+	err := s.SendVerificationCode(ctx, "investor@example.com, dev@ditto.trade", "111111")
+	require.ErrorIs(t, err, ErrInvalidRecipient)
+	require.False(t, IsRetryable(err))
+	require.NoError(t, s.SendVerificationCode(ctx, "Dev <dev@ditto.trade>", "111111"))
+	require.Equal(t, 3, outbox.Len())
+	outbox.Reset()
+	require.NoError(t, s.SendVerificationCode(ctx, "dev@ditto.trade", "111111"))
+	email, _ := outbox.AssertSent(t, VerificationCodeTmpl, "dev@ditto.trade")
+	require.Equal(t, "staging-verification", email.Tag)
+
+	cfg.Sandbox.Mode = SandboxRewrite
+	require.ErrorIs(t, cfg.Validate(), ErrInvalidConfig, "catch-all is required")
+	cfg.Sandbox.CatchAll = "catch-all@ditto.trade"
+	outbox.Reset()
+	s = New(outbox, cfg, WithTemplates(DefaultTemplates()))
+	require.NoError(t, s.SendVerificationCode(ctx, "investor@example.com", "111111"))
+	email, ok := outbox.AssertSent(t, VerificationCodeTmpl, "catch-all@ditto.trade")
+	require.True(t, ok)
+	require.Equal(t, "investor@example.com", email.TemplateModel["original_recipient"])
+	require.Equal(t, "[investor@example.com] Ditto Trade verification code", email.Subject)
+	require.NoError(t, s.SendVerificationCode(ctx, "QA <qa@example.com>", "111111"))
+	_, ok = outbox.AssertSent(t, VerificationCodeTmpl, "QA <qa@example.com>")
+	require.True(t, ok)
+}
+
+func TestService_TagProduction(t *testing.T) {
+	cfg := testConfig
+	cfg.Environment = ProductionEnvironment
+	outbox := NewOutbox()
+	s := New(outbox, cfg)
+	require.NoError(t, s.SendVerificationCode(context.TODO(), "investor@ditto.trade", "111111"))
+	email, ok := outbox.AssertSent(t, VerificationCodeTmpl, "investor@ditto.trade")
+	require.True(t, ok)
+	require.Equal(t, "verification", email.Tag)
+}
@@ -0,0 +1,46 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dittotrade/internal/db"
+)
+
+// SendAt stores email in mail_queue to be sent by Dispatcher at the given time and returns its id,
+// see CancelQueued. Brand defaults to the one of ctx, see ContextWithBrand.
+// Model, recipient and metadata are checked immediately, so a broken email fails here rather than when due.
+// Model is stored in plain text until the email is sent, never schedule OTP codes or other secrets:
+// send them immediately or let the scheduled email link to a page which issues them.
+// Call it inside db.Transaction to schedule the email atomically with business changes.
+func (s *Service) SendAt(ctx context.Context, dbtx db.DBTX, at time.Time, email QueuedEmail) (int64, error) {
+	data, err := templateModel(email.Model)
+	if err != nil {
+		return 0, fmt.Errorf("could not schedule email: %w", err)
+	}
+	o := sendOptions{locale: email.Locale, brand: email.Brand}
+	if err = s.resolveBrand(ctx, &o); err != nil {
+		return 0, fmt.Errorf("could not schedule email: %w", err)
+	}
+	address, err := recipientAddress(email.To)
+	if err != nil {
+		return 0, fmt.Errorf("could not schedule email: %w", err)
+	}
+	if err = checkMetadata(email.Metadata); err != nil {
+		return 0, fmt.Errorf("could not schedule email: %w", err)
+	}
+	locale := s.resolveLocale(o.locale)
+	payload := s.payload(email.Template, email.To, address, data, locale,
+		localizedConfig(s.brandConfig(o.brand), locale))
+	if err = s.validateModel(s.localizedTemplate(email.Template, locale), email.Template, payload); err != nil {
+		return 0, fmt.Errorf("could not schedule email: %w", err)
+	}
+	email.Brand, email.At = o.brand, at
+	return Enqueue(ctx, dbtx, email)
+}
+
+// SendAfter stores email to be sent by Dispatcher after delay, see SendAt
+func (s *Service) SendAfter(ctx context.Context, dbtx db.DBTX, delay time.Duration, email QueuedEmail) (int64, error) {
+	return s.SendAt(ctx, dbtx, time.Now().Add(delay), email)
+}
@@ -0,0 +1,92 @@
+package mail
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dittotrade/internal/db"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_SendAtInvalid(t *testing.T) {
+	cfg := testConfig
+	cfg.Brands = testBrands
+	s := New(NewOutbox(), cfg, WithTemplates(DefaultTemplates()))
+	ctx := context.TODO()
+	alert := QueuedEmail{
+		Template: StopLossTmpl,
+		Tag:      stopLossTag,
+		To:       "investor@ditto.trade",
+		Model:    map[string]interface{}{"strategy": "Alpha"},
+	}
+	// emails are checked before the database is touched
+	_, err := s.SendAfter(ctx, nil, time.Minute, alert)
+	require.ErrorIs(t, err, ErrMissingTemplateVars)
+
+	alert.Model = StopLossModel{StrategyName: "Alpha", StrategyID: uuid.New(), Equity: 900, StopLoss: 1000}
+	_, err = s.SendAfter(ContextWithBrand(ctx, "unknown"), nil, time.Minute, alert)
+	require.ErrorIs(t, err, ErrUnknownBrand)
+
+	alert.To = "investor@ditto.trade, qa@ditto.trade"
+	_, err = s.SendAfter(ctx, nil, time.Minute, alert)
+	require.ErrorIs(t, err, ErrInvalidRecipient)
+}
+
+func TestDispatcher_Scheduled(t *testing.T) {
+	database := openTestDB(t)
+	ctx := context.TODO()
+	require.NoError(t, CreateQueueTable(ctx, database))
+
+	recipient := "scheduled-" + uuid.NewString() + "@ditto.trade"
+	defer func() {
+		_, _ = database.ExecContext(ctx, "DELETE FROM mail_queue WHERE recipient = $1", recipient)
+	}()
+	outbox := NewOutbox()
+	cfg := testConfig
+	cfg.Brands = testBrands
+	s := New(outbox, cfg)
+	// the reminder links to the page which issues the code, codes are never stored in the queue
+	reminder := QueuedEmail{Template: "destroy_account_reminder", Tag: "destroy_account_reminder", To: recipient,
+		Critical: true, Metadata: map[string]string{"user_id": "u1"},
+		Model: map[string]interface{}{"confirm_url": "https://ditto.trade/account/destroy"}}
+	var due, later, cancelled int64
+	err := db.Transaction(database)(func(tx db.DBTX) (err error) {
+		if due, err = s.SendAt(ContextWithBrand(ctx, "partner"), tx, time.Now().Add(-time.Second),
+			reminder); err != nil {
+			return err
+		}
+		if later, err = s.SendAfter(ctx, tx, time.Hour, reminder); err != nil {
+			return err
+		}
+		cancelled, err = s.SendAfter(ctx, tx, -time.Minute, reminder)
+		return err
+	})
+	require.NoError(t, err)
+	require.NoError(t, CancelQueued(ctx, database, cancelled))
+	require.ErrorIs(t, CancelQueued(ctx, database, cancelled), ErrNotPending)
+
+	d := NewDispatcher(database, s)
+	d.BatchSize = 1000
+	d.PollInterval = 10 * time.Millisecond
+	d.LockTable = "mail_queue_test_lock"
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() { done <- d.Run(runCtx) }()
+	require.Eventually(t, func() bool { return len(outbox.SentTo(recipient)) == 1 }, 5*time.Second,
+		10*time.Millisecond)
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+
+	email := outbox.SentTo(recipient)[0]
+	require.Equal(t, `"Partner Invest" <no-reply@partner.example>`, email.From)
+	require.Equal(t, "u1", email.Metadata["user_id"])
+	for id, status := range map[int64]string{due: QueueStatusSent, later: QueueStatusPending,
+		cancelled: QueueStatusCancelled} {
+		var got string
+		require.NoError(t, database.QueryRowContext(ctx, "SELECT status FROM mail_queue WHERE id = $1",
+			id).Scan(&got))
+		require.Equal(t, status, got)
+	}
+}
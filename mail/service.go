@@ -2,11 +2,16 @@ package mail
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"github.com/dmitrymomot/go-env"
+	"log"
+	"net/http"
+	netmail "net/mail"
+	"sync"
+	"time"
 
+	"github.com/dittotrade/internal/db"
 	"github.com/google/uuid"
-
 	"github.com/keighl/postmark"
 )
 
@@ -18,11 +23,29 @@ var (
 	StopLossTmpl           = "stop_loss"
 )
 
+// DefaultTimeout limits send duration when Config.Timeout is not set
+const DefaultTimeout = 30 * time.Second
+
 type (
 	// Service struct
 	Service struct {
-		client postmarkClient
-		config Config
+		transport    Transport
+		config       Config
+		templates    *Templates
+		httpClient   *http.Client
+		suppressions SuppressionList
+		limiter      RateLimiter
+		idempotency  IdempotencyStore
+		auditLog     AuditLog
+		preferences  Preferences
+		digestQueue  db.DBTX
+		// fallbacks follow transport in failover order, see circuits
+		fallbacks    []Transport
+		circuitsOnce sync.Once
+		circuitList  []*circuit
+		// streams are Postmark message streams by template category
+		streams    map[string]string
+		categories map[string]string
 	}
 
 	// Config struct
@@ -35,111 +58,362 @@ type (
 		CompanyAddress string
 		FromEmail      string
 		FromName       string
+		// Timeout limits each send, DefaultTimeout is used if zero
+		Timeout time.Duration
+		// Retry of transient failures, DefaultRetryPolicy is used if zero
+		Retry RetryPolicy
+		// Breaker of every transport, DefaultBreakerConfig is used if zero, see WithFallbackTransports
+		Breaker BreakerConfig
+		// DefaultLocale of emails, DefaultLocale ("en") is used if empty
+		DefaultLocale string
+		// Locales lists supported locales besides the default one with their overrides
+		Locales map[string]LocaleConfig
+		// Transport is one of TransportPostmark (default), TransportSMTP or TransportFile,
+		// it is ignored when WithTransport option is given
+		Transport            string
+		PostmarkServerToken  string
+		PostmarkAccountToken string
+		SMTP                 SMTPConfig
+		// OutboxDir is a directory of TransportFile
+		OutboxDir string
+		// Environment prefixes Tag of every email unless it is empty or ProductionEnvironment,
+		// e.g. "staging-verification"
+		Environment string
+		// Sandbox restricts recipients outside production
+		Sandbox SandboxConfig
+		// MaxAttachmentsSize limits total size of attachments of an email, see DefaultMaxAttachmentsSize
+		MaxAttachmentsSize int64
+		// IdempotencyTTL is a window of deduplication, see WithIdempotencyStore
+		IdempotencyTTL time.Duration
+		// RateLimits per recipient by template, nil means DefaultRateLimits, see WithRateLimiter
+		RateLimits map[string]RateLimit
+		// UnsubscribeURL is a page which opts recipient out by "token" query parameter, see Service.Unsubscribe.
+		// Emails of optional categories link to it by unsubscribe_url variable.
+		UnsubscribeURL string
+		// UnsubscribeSecret signs unsubscribe tokens, it is required with UnsubscribeURL
+		UnsubscribeSecret string
+		// Brands are partner brands by ID, see WithBrand and ContextWithBrand
+		Brands map[string]Brand
+		// DigestWindow buffers stop loss notifications of a recipient and sends them as StopLossDigestTmpl,
+		// zero disables digests, see WithDigestQueue and WithUrgent
+		DigestWindow time.Duration
+		// TemplateMode is TemplatesLocal or TemplatesPostmark,
+		// it defaults to TemplatesPostmark for Postmark transport and TemplatesLocal otherwise
+		TemplateMode string
 	}
+)
 
-	postmarkClient interface {
-		SendTemplatedEmail(email postmark.TemplatedEmail) (postmark.EmailResponse, error)
+// New creates mail Service which delivers emails through transport.
+// Unlike NewService it does not validate config.
+func New(transport Transport, config Config, opts ...Option) *Service {
+	s := &Service{transport: transport, config: config}
+	for _, opt := range opts {
+		opt(s)
 	}
-)
+	if s.limiter == nil {
+		s.limiter = NewMemoryRateLimiter()
+	}
+	return s
+}
 
+// NewService creates Service from validated config.
+// Transport is built from Config unless WithTransport option is given.
+func NewService(cfg Config, opts ...Option) (*Service, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	s := New(nil, cfg, opts...)
+	if s.transport == nil {
+		if err := cfg.validateTransport(); err != nil {
+			return nil, err
+		}
+		transport, err := newTransport(cfg, s.httpClient)
+		if err != nil {
+			return nil, err
+		}
+		s.transport = transport
+	}
+	if s.templates == nil && cfg.templateMode() == TemplatesLocal {
+		s.templates = DefaultTemplates()
+	}
+	return s, nil
+}
+
+// GetMailer creates Service configured by environment variables (see LoadConfigFromEnv).
+// It terminates the program if configuration is invalid.
 func GetMailer() *Service {
-	postmarkServerToken := env.MustString("POSTMARK_SERVER_TOKEN")
-	postmarkAccountToken := env.MustString("POSTMARK_ACCOUNT_TOKEN")
-	// Product
-	productName := env.GetString("PRODUCT_NAME", "Ditto Trade")
-	productURL := env.GetString("PRODUCT_URL", "https://ditto.trade")
-	supportURL := env.GetString("SUPPORT_URL", "https://ditto.trade/support")
-	supportEmail := env.GetString("SUPPORT_EMAIL", "support@ditto.trade")
-	companyName := env.GetString("COMPANY_NAME", "Ditto Trade Pty Limited")
-	companyAddress := env.GetString("COMPANY_ADDRESS", "Level 27, 25 Bligh Street, Sydney NSW 2000")
-	// Mailer
-	notificationFromName := env.GetString("NOTIFICATION_FROM_NAME", "Ditto Trade")
-	notificationFromEmail := env.GetString("NOTIFICATION_FROM_EMAIL", "notifications@ditto.trade")
-	client := postmark.NewClient(postmarkServerToken, postmarkAccountToken)
-	config := Config{
-		ProductName:    productName,
-		ProductURL:     productURL,
-		SupportURL:     supportURL,
-		SupportEmail:   supportEmail,
-		CompanyName:    companyName,
-		CompanyAddress: companyAddress,
-		FromEmail:      notificationFromEmail,
-		FromName:       notificationFromName,
-	}
-	return &Service{client: client, config: config}
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		log.Fatalf("could not load mail config: %s", err)
+	}
+	s, err := NewService(cfg)
+	if err != nil {
+		log.Fatalf("could not create mail service: %s", err)
+	}
+	return s
+}
+
+// newTransport creates Transport selected by Config.Transport
+func newTransport(cfg Config, httpClient *http.Client) (Transport, error) {
+	switch cfg.transport() {
+	case TransportSMTP:
+		return NewSMTPTransport(cfg.SMTP, nil), nil
+	case TransportFile:
+		return NewFileOutbox(cfg.OutboxDir, nil)
+	default:
+		client := postmark.NewClient(cfg.PostmarkServerToken, cfg.PostmarkAccountToken)
+		if httpClient != nil {
+			client.HTTPClient = httpClient
+		}
+		return NewPostmarkClientTransport(client), nil
+	}
 }
 
 // SendVerificationCode ...
-func (s *Service) SendVerificationCode(_ context.Context, email, otp string) error {
-	if err := s.send(VerificationCodeTmpl, "verification", email, map[string]interface{}{
-		"otp": otp,
-	}); err != nil {
+func (s *Service) SendVerificationCode(ctx context.Context, email, otp string, opts ...SendOption) error {
+	if _, err := s.Send(ctx, VerificationCodeTmpl, "verification", email, OTPModel{OTP: otp}, opts...); err != nil {
 		return fmt.Errorf("could not send verification code: %w", err)
 	}
 	return nil
 }
 
 // SendResetPasswordCode ...
-func (s *Service) SendResetPasswordCode(_ context.Context, email, otp string) error {
-	if err := s.send(PasswordResetTmpl, "reset_password", email, map[string]interface{}{
-		"otp": otp,
-	}); err != nil {
+func (s *Service) SendResetPasswordCode(ctx context.Context, email, otp string, opts ...SendOption) error {
+	if _, err := s.Send(ctx, PasswordResetTmpl, "reset_password", email, OTPModel{OTP: otp}, opts...); err != nil {
 		return fmt.Errorf("could not send reset password code: %w", err)
 	}
 	return nil
 }
 
 // SendDestroyAccountCode ...
-func (s *Service) SendDestroyAccountCode(_ context.Context, email, otp string) error {
-	if err := s.send(DestroyAccountCodeTmpl, "destroy_account", email, map[string]interface{}{
-		"otp": otp,
-	}); err != nil {
+func (s *Service) SendDestroyAccountCode(ctx context.Context, email, otp string, opts ...SendOption) error {
+	if _, err := s.Send(ctx, DestroyAccountCodeTmpl, "destroy_account", email, OTPModel{OTP: otp}, opts...); err != nil {
 		return fmt.Errorf("could not send verification code: %w", err)
 	}
 	return nil
 }
 
-func (s *Service) SendNotificationStopLoss(_ context.Context, email, strategyName string, strategyID uuid.UUID, currentEquity, stopLoss float64) error {
-	if err := s.send(StopLossTmpl, "investment_stop_loss", email, map[string]interface{}{
-		"strategy_name": strategyName,
-		"strategy_id":   strategyID,
-		"equity":        currentEquity,
-		"stopLoss":      stopLoss,
-	}); err != nil {
+func (s *Service) SendNotificationStopLoss(ctx context.Context, email, strategyName string, strategyID uuid.UUID,
+	currentEquity, stopLoss float64, opts ...SendOption) error {
+	model := StopLossModel{
+		StrategyName: strategyName,
+		StrategyID:   strategyID,
+		Equity:       currentEquity,
+		StopLoss:     stopLoss,
+	}
+	if o := s.sendOptions(opts); s.digests(o) {
+		if err := s.addToDigest(ctx, email, model, o); err != nil {
+			return fmt.Errorf("could not buffer stop loss notification: %w", err)
+		}
+		return nil
+	}
+	if _, err := s.Send(ctx, StopLossTmpl, stopLossTag, email, model, opts...); err != nil {
 		return fmt.Errorf("could not send verification code: %w", err)
 	}
 	return nil
 }
 
-// send email
-func (s *Service) send(tpl, tag, email string, data map[string]interface{}) error {
+const stopLossTag = "investment_stop_loss"
+
+// send email retrying transient failures,
+// the call including retries is limited by timeout of SendOption or Config
+func (s *Service) send(ctx context.Context, tpl, tag, email string, data map[string]interface{},
+	opts ...SendOption) (res Response, err error) {
+	o := s.sendOptions(opts)
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+	if o.attachments, err = readAttachments(o.attachments, s.maxAttachmentsSize()); err != nil {
+		err = fmt.Errorf("could not send email: %w", err)
+		s.auditSkipped(tpl, tag, email, data, o, AuditStatusRefused, Response{}, err)
+		return Response{}, err
+	}
+	if o.response != nil {
+		defer func() {
+			if err == nil {
+				*o.response = res
+			}
+		}()
+	}
+
+	p, err := s.prepare(ctx, tpl, tag, email, data, o)
+	s.auditPrepared(tpl, tag, email, data, o, p, err)
+	if err != nil {
+		return Response{}, err
+	}
+	if p.done {
+		return p.res, nil
+	}
+	// transport attempts are audited by deliver
+	err = s.retryPolicy().retry(ctx, func() (err error) {
+		res, err = s.deliver(ctx, p)
+		return err
+	})
+	s.finish(p, res, err)
+	if err != nil {
+		return Response{}, fmt.Errorf("could not send email: %w", wrapContextError(ctx, err))
+	}
+	return res, nil
+}
+
+// prepared is an email which passed checks and is ready for transport
+type prepared struct {
+	email Email
+	// address is the bare original recipient, email.To may have a display name or be rewritten by sandbox
+	address string
+	// key is reserved idempotency key completed for ttl, see finish
+	key string
+	ttl time.Duration
+	// done email is not sent: it is a duplicate with Response res of the first one
+	// or it is dropped by sandbox
+	done    bool
+	dropped bool
+	res     Response
+	// failover allows fallback transports, see WithFallbackTransports
+	failover bool
+}
+
+// prepare checks that email may be sent and renders it
+func (s *Service) prepare(ctx context.Context, tpl, tag, email string, data map[string]interface{},
+	o sendOptions) (p prepared, err error) {
+	if err = ctx.Err(); err != nil {
+		return p, fmt.Errorf("could not send email: %w", err)
+	}
+	if err = s.resolveBrand(ctx, &o); err != nil {
+		return p, fmt.Errorf("could not send email: %w", err)
+	}
+	// checks use the bare address, so that lists and display names cannot bypass them
+	address, err := recipientAddress(email)
+	if err != nil {
+		return p, fmt.Errorf("could not send email: %w", err)
+	}
+	if s.sandboxDrops(tpl, address) {
+		return prepared{address: address, done: true, dropped: true, res: Response{To: email}}, nil
+	}
+	if s.suppressions != nil && !o.critical {
+		suppressed, err := s.suppressions.IsSuppressed(ctx, address)
+		if err != nil {
+			return p, fmt.Errorf("could not send email: %w", err)
+		}
+		if suppressed {
+			return p, fmt.Errorf("could not send email to %s: %w", email, ErrSuppressed)
+		}
+	}
+	if err = s.checkPreferences(ctx, tpl, address, o); err != nil {
+		return p, fmt.Errorf("could not send email to %s: %w", email, err)
+	}
+
+	if key := s.idempotencyKey(tpl, address, data, o); key != "" {
+		var original Response
+		var reserved bool
+		if original, reserved, err = s.idempotency.Reserve(ctx, key, s.idempotencyLease(tpl, o)); err != nil {
+			return p, fmt.Errorf("could not send email: %w", err)
+		}
+		if !reserved {
+			return prepared{address: address, done: true, res: original}, nil
+		}
+		p.key, p.ttl = key, s.idempotencyTTL(tpl)
+		defer func() {
+			if err != nil {
+				s.finish(p, Response{}, err)
+			}
+		}()
+	}
+
+	if err = s.checkRateLimit(ctx, tpl, address); err != nil {
+		return p, fmt.Errorf("could not send email: %w", err)
+	}
+	p.address = address
+	p.email, err = s.compose(tpl, tag, email, address, data, o)
+	p.failover = o.critical || s.category(tpl) == CategorySecurity
+	return p, err
+}
+
+// fromAddress returns FromEmail with FromName as a display name
+func fromAddress(cfg Config) string {
+	if cfg.FromName == "" {
+		return cfg.FromEmail
+	}
+	return (&netmail.Address{Name: cfg.FromName, Address: cfg.FromEmail}).String()
+}
+
+// recipientAddress returns address of a single recipient, lists are rejected
+func recipientAddress(email string) (string, error) {
+	addr, err := netmail.ParseAddress(email)
+	if err != nil {
+		return "", &SendError{Kind: ErrInvalidRecipient, Err: fmt.Errorf("%q: %w", email, err)}
+	}
+	return addr.Address, nil
+}
+
+// compose builds email to recipient email with bare address merging data with Config defaults
+func (s *Service) compose(tpl, tag, email, address string, data map[string]interface{}, o sendOptions) (Email, error) {
+	locale := s.resolveLocale(o.locale)
+	cfg := localizedConfig(s.brandConfig(o.brand), locale)
+	payload := s.payload(tpl, email, address, data, locale, cfg)
+
+	msg := Email{
+		TemplateAlias: s.localizedTemplate(tpl, locale),
+		InlineCSS:     true,
+		TrackOpens:    true,
+		From:          fromAddress(cfg),
+		To:            email,
+		Tag:           s.tag(tag),
+		ReplyTo:       cfg.SupportEmail,
+		TemplateModel: payload,
+		Attachments:   o.attachments,
+		MessageStream: s.messageStream(tpl),
+		Metadata:      metadata(data, o),
+	}
+	if err := checkMetadata(msg.Metadata); err != nil {
+		return Email{}, fmt.Errorf("could not send email: %w", err)
+	}
+	if err := s.validateModel(msg.TemplateAlias, tpl, payload); err != nil {
+		return Email{}, fmt.Errorf("could not send email: %w", err)
+	}
+	if s.templates != nil && s.templates.Has(msg.TemplateAlias) {
+		var err error
+		if msg.Subject, msg.HTMLBody, msg.TextBody, err = s.templates.Render(msg.TemplateAlias, payload); err != nil {
+			return Email{}, fmt.Errorf("could not render email: %w", err)
+		}
+	}
+	s.sandboxRewrite(&msg)
+
+	return msg, nil
+}
+
+// payload merges data with Config defaults, unsubscribe link is signed for bare address
+// as preferences are checked for it
+func (s *Service) payload(tpl, email, address string, data map[string]interface{}, locale string,
+	cfg Config) map[string]interface{} {
 	// Default model data
 	payload := map[string]interface{}{
-		"product_url":     s.config.ProductURL,
-		"product_name":    s.config.ProductName,
-		"support_url":     s.config.SupportURL,
-		"company_name":    s.config.CompanyName,
-		"company_address": s.config.CompanyAddress,
+		"product_url":     cfg.ProductURL,
+		"product_name":    cfg.ProductName,
+		"support_url":     cfg.SupportURL,
+		"company_name":    cfg.CompanyName,
+		"company_address": cfg.CompanyAddress,
 		"email":           email,
+		"locale":          locale,
+		"unsubscribe_url": s.unsubscribeURL(tpl, address),
 	}
+	formatNumbers(payload, data, locale)
 
 	// Merge custom data with default fields
 	for k, v := range data {
 		payload[k] = v
 	}
+	return payload
+}
 
-	if _, err := s.client.SendTemplatedEmail(postmark.TemplatedEmail{
-		TemplateAlias: tpl,
-		InlineCss:     true,
-		TrackOpens:    true,
-		From:          s.config.FromEmail,
-		To:            email,
-		Tag:           tag,
-		ReplyTo:       s.config.SupportEmail,
-		TemplateModel: payload,
-	}); err != nil {
-		return fmt.Errorf("could not send email: %w", err)
+// wrapContextError makes sure that error caused by cancelled or expired ctx
+// matches context.Canceled or context.DeadlineExceeded with errors.Is
+func wrapContextError(ctx context.Context, err error) error {
+	ctxErr := ctx.Err()
+	if ctxErr == nil || errors.Is(err, ctxErr) {
+		return err
 	}
-
-	return nil
+	return fmt.Errorf("%w: %s", ctxErr, err)
 }
@@ -0,0 +1,136 @@
+package mail
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	netmail "net/mail"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+var testConfig = Config{
+	ProductName:    "Ditto Trade",
+	ProductURL:     "https://ditto.trade",
+	SupportURL:     "https://ditto.trade/support",
+	SupportEmail:   "support@ditto.trade",
+	CompanyName:    "Ditto Trade Pty Limited",
+	CompanyAddress: "Level 27, 25 Bligh Street, Sydney NSW 2000",
+	FromEmail:      "notifications@ditto.trade",
+	FromName:       "Ditto Trade",
+}
+
+func TestService_SendNotificationStopLoss(t *testing.T) {
+	outbox := NewOutbox()
+	s := New(outbox, testConfig)
+	strategyID := uuid.New()
+	err := s.SendNotificationStopLoss(context.TODO(), "investor@ditto.trade", "Alpha", strategyID, 900, 1000)
+	require.NoError(t, err)
+	email, ok := outbox.AssertSent(t, StopLossTmpl, "investor@ditto.trade")
+	require.True(t, ok)
+	require.Equal(t, "investment_stop_loss", email.Tag)
+	require.Equal(t, `"Ditto Trade" <notifications@ditto.trade>`, email.From)
+	require.Equal(t, testConfig.SupportEmail, email.ReplyTo)
+	require.Equal(t, "Ditto Trade", email.TemplateModel["product_name"])
+	require.Equal(t, "investor@ditto.trade", email.TemplateModel["email"])
+	require.Equal(t, strategyID, email.TemplateModel["strategy_id"])
+	require.Equal(t, float64(1000), email.TemplateModel["stopLoss"])
+}
+
+func TestService_From(t *testing.T) {
+	outbox := NewOutbox()
+	cfg := testConfig
+	cfg.FromName = "Ditto Trade, Inc."
+	s := New(outbox, cfg)
+	require.NoError(t, s.SendVerificationCode(context.TODO(), "user01@ditto.trade", "111111"))
+	email, _ := outbox.Last()
+	require.Equal(t, `"Ditto Trade, Inc." <notifications@ditto.trade>`, email.From)
+
+	cfg.FromName = "Диттo"
+	s = New(outbox, cfg)
+	require.NoError(t, s.SendVerificationCode(context.TODO(), "user01@ditto.trade", "111111"))
+	email, _ = outbox.Last()
+	from, err := netmail.ParseAddress(email.From)
+	require.NoError(t, err)
+	require.Equal(t, "Диттo", from.Name)
+	require.Equal(t, "notifications@ditto.trade", from.Address)
+
+	cfg.FromName = ""
+	s = New(outbox, cfg)
+	require.NoError(t, s.SendVerificationCode(context.TODO(), "user01@ditto.trade", "111111"))
+	email, _ = outbox.Last()
+	require.Equal(t, "notifications@ditto.trade", email.From)
+}
+
+func TestService_ContextCancelled(t *testing.T) {
+	s := New(NewOutbox(), testConfig)
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	err := s.SendVerificationCode(ctx, "user01@ditto.trade", "111111")
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestService_Timeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(200 * time.Millisecond):
+		}
+	}))
+	defer srv.Close()
+	tr := NewPostmarkTransport("server-token", "account-token")
+	tr.client.BaseURL = srv.URL
+	cfg := testConfig
+	cfg.Timeout = time.Second
+	s := New(tr, cfg)
+	start := time.Now()
+	err := s.SendVerificationCode(context.TODO(), "user01@ditto.trade", "111111", WithTimeout(20*time.Millisecond))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), cfg.Timeout)
+}
+
+func TestService_Locale(t *testing.T) {
+	templates, err := LoadTemplates(fstest.MapFS{
+		"stop_loss/subject.txt":    {Data: []byte("Stop loss {{.strategy_name}}")},
+		"stop_loss/body.html":      {Data: []byte("<p>{{.equity_formatted}}</p>")},
+		"stop_loss.de/subject.txt": {Data: []byte("Stop-Loss {{.strategy_name}}")},
+		"stop_loss.de/body.html":   {Data: []byte("<p>{{.product_name}}: {{.equity_formatted}}</p>")},
+	})
+	require.NoError(t, err)
+	cfg := testConfig
+	cfg.Locales = map[string]LocaleConfig{"de": {ProductName: "Ditto Handel"}, "fr": {}}
+	outbox := NewOutbox()
+	s := New(outbox, cfg, WithTemplates(templates))
+	ctx := context.TODO()
+
+	require.NoError(t, s.SendNotificationStopLoss(ctx, "de@ditto.trade", "Alpha", uuid.New(), 12345.6, 1000,
+		WithLocale("de_AT")))
+	email := outbox.SentTo("de@ditto.trade")[0]
+	require.Equal(t, "stop_loss.de", email.TemplateAlias)
+	require.Equal(t, "<p>Ditto Handel: 12.345,60</p>", email.HTMLBody)
+
+	// no local french translation: default template with french numbers
+	require.NoError(t, s.SendNotificationStopLoss(ctx, "fr@ditto.trade", "Alpha", uuid.New(), 12345.6, 1000,
+		WithLocale("fr")))
+	email = outbox.SentTo("fr@ditto.trade")[0]
+	require.Equal(t, StopLossTmpl, email.TemplateAlias)
+	require.Equal(t, "<p>12\u00a0345,60</p>", email.HTMLBody)
+
+	// unsupported locale falls back to default
+	require.NoError(t, s.SendNotificationStopLoss(ctx, "ja@ditto.trade", "Alpha", uuid.New(), -0.001, 1000,
+		WithLocale("ja")))
+	email = outbox.SentTo("ja@ditto.trade")[0]
+	require.Equal(t, "en", email.TemplateModel["locale"])
+	require.Equal(t, "<p>0.00</p>", email.HTMLBody)
+}
+
+func TestFormatNumber(t *testing.T) {
+	require.Equal(t, "1,234,567.89", FormatNumber("en", 1234567.891, 2))
+	require.Equal(t, "-1.234,50", FormatNumber("pt-BR", -1234.5, 2))
+	require.Equal(t, "1'000.00", FormatNumber("de_CH", 1000, 2))
+	require.Equal(t, "999", FormatNumber("de", 999, 0))
+}
@@ -0,0 +1,273 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrNoStartTLS is returned when SMTPConfig.RequireTLS is set and server does not support STARTTLS
+var ErrNoStartTLS = errors.New("smtp server does not support STARTTLS")
+
+type (
+	// SMTPConfig holds connection settings for SMTPTransport
+	SMTPConfig struct {
+		Host     string
+		Port     int
+		Username string
+		Password string
+		// RequireTLS refuses to send emails if server does not support STARTTLS
+		RequireTLS bool
+		// TLSConfig is used for STARTTLS, ServerName defaults to Host
+		TLSConfig *tls.Config
+		// LocalName is sent with EHLO, "localhost" by default
+		LocalName string
+	}
+
+	// RenderFunc renders templated email into subject, html and text bodies
+	RenderFunc func(email Email) (subject, htmlBody, textBody string, err error)
+
+	// SMTPTransport sends emails through SMTP server.
+	// Emails which are not Rendered yet are rendered by RenderFunc.
+	SMTPTransport struct {
+		config SMTPConfig
+		render RenderFunc
+	}
+)
+
+// NewSMTPTransport creates SMTP Transport, DefaultTemplates are used when render is nil
+func NewSMTPTransport(config SMTPConfig, render RenderFunc) *SMTPTransport {
+	if config.Port == 0 {
+		config.Port = 587
+	}
+	if config.LocalName == "" {
+		config.LocalName = "localhost"
+	}
+	if render == nil {
+		render = DefaultTemplates().RenderEmail
+	}
+	return &SMTPTransport{config: config, render: render}
+}
+
+// Send renders email and delivers it to SMTP server
+func (t *SMTPTransport) Send(ctx context.Context, email Email) (Response, error) {
+	subject, htmlBody, textBody, err := renderEmail(email, t.render)
+	if err != nil {
+		return Response{}, fmt.Errorf("smtp: could not render template %s: %w", email.TemplateAlias, err)
+	}
+	now := time.Now()
+	messageID := newMessageID(email.From)
+	msg, err := buildMessage(email, subject, htmlBody, textBody, messageID, now)
+	if err != nil {
+		return Response{}, fmt.Errorf("smtp: could not build message: %w", err)
+	}
+	from, to, err := envelope(email)
+	if err != nil {
+		return Response{}, fmt.Errorf("smtp: %w", err)
+	}
+	if err = t.deliver(ctx, from, to, msg); err != nil {
+		return Response{}, fmt.Errorf("smtp: %w", err)
+	}
+	return Response{To: email.To, MessageID: messageID, SubmittedAt: now}, nil
+}
+
+// deliver runs SMTP session, the connection is interrupted when ctx is done
+func (t *SMTPTransport) deliver(ctx context.Context, from string, to []string, msg []byte) (err error) {
+	defer func() {
+		if err == nil || errors.Is(err, ErrNoStartTLS) {
+			return
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = fmt.Errorf("%w: %s", ctxErr, err)
+			return
+		}
+		err = smtpError(err)
+	}()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(t.config.Host, strconv.Itoa(t.config.Port)))
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	c, err := smtp.NewClient(conn, t.config.Host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer func() { _ = c.Close() }()
+	if err = c.Hello(t.config.LocalName); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		tlsConfig := t.config.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{ServerName: t.config.Host, MinVersion: tls.VersionTLS12}
+		}
+		if err = c.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("starttls: %w", err)
+		}
+	} else if t.config.RequireTLS {
+		return ErrNoStartTLS
+	}
+	if t.config.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", t.config.Username, t.config.Password, t.config.Host)); err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err = c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// renderEmail returns bodies of Rendered email or renders it
+func renderEmail(email Email, render RenderFunc) (subject, htmlBody, textBody string, err error) {
+	if email.Rendered() {
+		return email.Subject, email.HTMLBody, email.TextBody, nil
+	}
+	return render(email)
+}
+
+// RenderPlainText is a fallback RenderFunc which lists template model as a plain text email
+func RenderPlainText(email Email) (subject, htmlBody, textBody string, err error) {
+	subject = strings.ReplaceAll(email.TemplateAlias, "_", " ")
+	if name, ok := email.TemplateModel["product_name"]; ok {
+		subject = fmt.Sprintf("%v: %s", name, subject)
+	}
+	keys := make([]string, 0, len(email.TemplateModel))
+	for k := range email.TemplateModel {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s: %v\r\n", k, email.TemplateModel[k])
+	}
+	return subject, "", b.String(), nil
+}
+
+// buildMessage composes RFC 5322 message, multipart/alternative if both bodies are present,
+// see messageBody for structure of message with attachments
+func buildMessage(email Email, subject, htmlBody, textBody, messageID string, date time.Time) ([]byte, error) {
+	if err := checkMetadata(email.Metadata); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	writeHeader := func(k, v string) {
+		if v != "" {
+			fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+		}
+	}
+	writeHeader("From", email.From)
+	writeHeader("To", email.To)
+	writeHeader("Reply-To", email.ReplyTo)
+	writeHeader("Subject", mime.QEncoding.Encode("utf-8", subject))
+	writeHeader("Date", date.Format(time.RFC1123Z))
+	writeHeader("Message-ID", messageID)
+	writeHeader("X-Tag", email.Tag)
+	keys := make([]string, 0, len(email.Metadata))
+	for k := range email.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeHeader("X-Metadata-"+k, mime.QEncoding.Encode("utf-8", email.Metadata[k]))
+	}
+	writeHeader("MIME-Version", "1.0")
+
+	body, err := messageBody(htmlBody, textBody, email.Attachments)
+	if err != nil {
+		return nil, err
+	}
+	writeHeader("Content-Type", body.header.Get("Content-Type"))
+	writeHeader("Content-Transfer-Encoding", body.header.Get("Content-Transfer-Encoding"))
+	buf.WriteString("\r\n")
+	if err := body.write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qw := quotedprintable.NewWriter(w)
+	if _, err := qw.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qw.Close()
+}
+
+// envelope returns bare addresses of sender and recipients for MAIL and RCPT commands,
+// headers keep display names
+func envelope(email Email) (from string, to []string, err error) {
+	sender, err := netmail.ParseAddress(email.From)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid sender %q: %w", email.From, err)
+	}
+	recipients, err := netmail.ParseAddressList(email.To)
+	if err != nil {
+		return "", nil, &SendError{Kind: ErrInvalidRecipient, Err: fmt.Errorf("%q: %w", email.To, err)}
+	}
+	for _, r := range recipients {
+		to = append(to, r.Address)
+	}
+	return sender.Address, to, nil
+}
+
+func newMessageID(from string) string {
+	domain := "localhost"
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		domain = strings.Trim(from[i+1:], "> ")
+	}
+	return fmt.Sprintf("<%s@%s>", uuid.NewString(), domain)
+}
+
+// splitList splits comma separated list dropping empty items
+func splitList(list string) []string {
+	var res []string
+	for _, a := range strings.Split(list, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			res = append(res, a)
+		}
+	}
+	return res
+}
@@ -0,0 +1,122 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSMTPServer accepts single connection and returns DATA payload via channel
+func fakeSMTPServer(t *testing.T) (host string, port int, data <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	ch := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		_ = tp.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.Fields(line)[0]); cmd {
+			case "EHLO", "HELO", "MAIL", "RCPT":
+				_ = tp.PrintfLine("250 OK")
+			case "DATA":
+				_ = tp.PrintfLine("354 go ahead")
+				b, _ := tp.ReadDotBytes()
+				ch <- string(b)
+				_ = tp.PrintfLine("250 queued")
+			case "QUIT":
+				_ = tp.PrintfLine("221 bye")
+				return
+			default:
+				_ = tp.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, ch
+}
+
+func TestSMTPTransport_Send(t *testing.T) {
+	host, port, data := fakeSMTPServer(t)
+	tr := NewSMTPTransport(SMTPConfig{Host: host, Port: port}, RenderPlainText)
+	res, err := tr.Send(context.TODO(), Email{
+		TemplateAlias: VerificationCodeTmpl,
+		TemplateModel: map[string]interface{}{"otp": "123456", "product_name": "Ditto Trade"},
+		From:          "notifications@ditto.trade",
+		To:            "user01@ditto.trade",
+		Tag:           "verification",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "user01@ditto.trade", res.To)
+	require.True(t, strings.HasSuffix(res.MessageID, "@ditto.trade>"))
+	select {
+	case msg := <-data:
+		require.Contains(t, msg, "Subject: Ditto Trade: verification code")
+		require.Contains(t, msg, "otp: 123456")
+		require.Contains(t, msg, "Message-ID: "+res.MessageID)
+	case <-time.After(time.Second):
+		t.Fatal("message was not delivered")
+	}
+}
+
+func TestSMTPTransport_RequireTLS(t *testing.T) {
+	host, port, _ := fakeSMTPServer(t)
+	tr := NewSMTPTransport(SMTPConfig{Host: host, Port: port, RequireTLS: true}, RenderPlainText)
+	_, err := tr.Send(context.TODO(), Email{TemplateAlias: VerificationCodeTmpl, From: "a@ditto.trade", To: "b@ditto.trade"})
+	require.ErrorIs(t, err, ErrNoStartTLS)
+}
+
+func TestEnvelope(t *testing.T) {
+	from, to, err := envelope(Email{From: `"Ditto Trade" <notifications@ditto.trade>`,
+		To: "Investor <investor@ditto.trade>, qa@ditto.trade"})
+	require.NoError(t, err)
+	require.Equal(t, "notifications@ditto.trade", from)
+	require.Equal(t, []string{"investor@ditto.trade", "qa@ditto.trade"}, to)
+
+	_, _, err = envelope(Email{From: "notifications@ditto.trade", To: "investor"})
+	require.ErrorIs(t, err, ErrInvalidRecipient)
+}
+
+func TestBuildMessage_Alternative(t *testing.T) {
+	msg, err := buildMessage(Email{From: "a@ditto.trade", To: "b@ditto.trade"}, "Привет", "<b>hi</b>", "hi",
+		"<id@ditto.trade>", time.Now())
+	require.NoError(t, err)
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(string(msg))))
+	h, err := r.ReadMIMEHeader()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(h.Get("Content-Type"), "multipart/alternative; boundary="))
+	require.Equal(t, "=?utf-8?q?=D0=9F=D1=80=D0=B8=D0=B2=D0=B5=D1=82?=", h.Get("Subject"))
+	require.Contains(t, string(msg), "<b>hi</b>")
+}
+
+func TestBuildMessage_Metadata(t *testing.T) {
+	msg, err := buildMessage(Email{From: "a@ditto.trade", To: "b@ditto.trade",
+		Metadata: map[string]string{"user_id": "42\r\nBcc: x@evil.com"}}, "Hi", "", "hi", "<id@ditto.trade>",
+		time.Now())
+	require.NoError(t, err)
+	h, err := textproto.NewReader(bufio.NewReader(strings.NewReader(string(msg)))).ReadMIMEHeader()
+	require.NoError(t, err)
+	require.Empty(t, h.Get("Bcc"))
+	require.NotEmpty(t, h.Get("X-Metadata-User_id"))
+
+	for _, key := range []string{"", "user id", "user_id: 1\r\nBcc", "user:id", "ключ"} {
+		_, err = buildMessage(Email{From: "a@ditto.trade", To: "b@ditto.trade",
+			Metadata: map[string]string{key: "42"}}, "Hi", "", "hi", "<id@ditto.trade>", time.Now())
+		require.Error(t, err, key)
+	}
+}
@@ -0,0 +1,103 @@
+package mail
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dittotrade/internal/db"
+)
+
+// SuppressionSchema creates table used by PostgresSuppressionList
+const SuppressionSchema = `
+create table if not exists mail_suppressions (
+	email         text primary key,
+	reason        text not null,
+	description   text not null default '',
+	message_id    text not null default '',
+	suppressed_at timestamptz not null default now()
+);
+`
+
+type (
+	// Suppression is a recipient which must not receive emails
+	Suppression struct {
+		Email string
+		// Reason is Postmark bounce type, e.g. HardBounce or SpamComplaint
+		Reason      string
+		Description string
+		// MessageID of the bounced email
+		MessageID    string
+		SuppressedAt time.Time
+	}
+
+	// SuppressionList stores recipients which hard bounced or complained
+	SuppressionList interface {
+		IsSuppressed(ctx context.Context, email string) (bool, error)
+		Suppress(ctx context.Context, suppression Suppression) error
+	}
+
+	// PostgresSuppressionList is SuppressionList stored in mail_suppressions table
+	PostgresSuppressionList struct {
+		dbtx db.DBTX
+	}
+)
+
+// CreateSuppressionTable creates mail_suppressions table if it does not exist
+func CreateSuppressionTable(ctx context.Context, dbtx db.DBTX) error {
+	if _, err := dbtx.ExecContext(ctx, SuppressionSchema); err != nil {
+		return fmt.Errorf("could not create mail_suppressions: %w", err)
+	}
+	return nil
+}
+
+// NewPostgresSuppressionList creates SuppressionList stored in Postgres
+func NewPostgresSuppressionList(dbtx db.DBTX) *PostgresSuppressionList {
+	return &PostgresSuppressionList{dbtx: dbtx}
+}
+
+// IsSuppressed reports whether email is in the list
+func (l *PostgresSuppressionList) IsSuppressed(ctx context.Context, email string) (bool, error) {
+	var one int
+	err := l.dbtx.QueryRowContext(ctx, `SELECT 1 FROM mail_suppressions WHERE email = $1`,
+		normalizeEmail(email)).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not check suppression of %s: %w", email, err)
+	}
+	return true, nil
+}
+
+// Suppress adds recipient to the list, repeated bounce updates the reason
+func (l *PostgresSuppressionList) Suppress(ctx context.Context, s Suppression) error {
+	if s.SuppressedAt.IsZero() {
+		s.SuppressedAt = time.Now()
+	}
+	_, err := l.dbtx.ExecContext(ctx, `INSERT INTO mail_suppressions(email, reason, description, message_id, suppressed_at)
+		VALUES ($1,$2,$3,$4,$5) ON CONFLICT (email) DO UPDATE SET reason = excluded.reason,
+		description = excluded.description, message_id = excluded.message_id, suppressed_at = excluded.suppressed_at`,
+		normalizeEmail(s.Email), s.Reason, s.Description, s.MessageID, s.SuppressedAt)
+	if err != nil {
+		return fmt.Errorf("could not suppress %s: %w", s.Email, err)
+	}
+	return nil
+}
+
+// Unsuppress removes recipient from the list, e.g. after the investor fixed the mailbox
+func (l *PostgresSuppressionList) Unsuppress(ctx context.Context, email string) error {
+	if _, err := l.dbtx.ExecContext(ctx, `DELETE FROM mail_suppressions WHERE email = $1`,
+		normalizeEmail(email)); err != nil {
+		return fmt.Errorf("could not unsuppress %s: %w", email, err)
+	}
+	return nil
+}
+
+// normalizeEmail makes addresses comparable, mailboxes are case-insensitive in practice
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,276 @@
+package mail
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"text/template/parse"
+)
+
+//go:embed templates
+var templatesFS embed.FS
+
+type (
+	// Templates is a registry of locally rendered email templates
+	Templates struct {
+		templates map[string]*localTemplate
+	}
+
+	localTemplate struct {
+		subject   *texttemplate.Template
+		html      *htmltemplate.Template
+		text      *texttemplate.Template
+		htmlEntry string
+		textEntry string
+		// vars are top level model variables used by the template
+		vars []string
+	}
+)
+
+var (
+	defaultTemplates     *Templates
+	defaultTemplatesOnce sync.Once
+)
+
+// DefaultTemplates returns templates embedded into the package (mail/templates)
+func DefaultTemplates() *Templates {
+	defaultTemplatesOnce.Do(func() {
+		sub, err := fs.Sub(templatesFS, "templates")
+		if err == nil {
+			defaultTemplates, err = LoadTemplates(sub)
+		}
+		if err != nil {
+			panic(fmt.Sprintf("embedded mail templates are broken: %s", err))
+		}
+	})
+	return defaultTemplates
+}
+
+// LoadTemplates parses templates from fsys.
+// Every directory is a template alias with subject.txt, body.html and optional body.txt.
+// Optional layout.html and layout.txt in the root define "layout" template,
+// a body which defines "content" is rendered inside of the layout.
+func LoadTemplates(fsys fs.FS) (*Templates, error) {
+	htmlLayout := htmltemplate.New("layout").Option("missingkey=error")
+	textLayout := texttemplate.New("layout").Option("missingkey=error")
+	if data, err := fs.ReadFile(fsys, "layout.html"); err == nil {
+		if _, err = htmlLayout.Parse(string(data)); err != nil {
+			return nil, fmt.Errorf("layout.html: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if data, err := fs.ReadFile(fsys, "layout.txt"); err == nil {
+		if _, err = textLayout.Parse(string(data)); err != nil {
+			return nil, fmt.Errorf("layout.txt: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	t := &Templates{templates: make(map[string]*localTemplate)}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		alias := e.Name()
+		tmpl, err := loadTemplate(fsys, alias, htmlLayout, textLayout)
+		if err != nil {
+			return nil, fmt.Errorf("template %s: %w", alias, err)
+		}
+		t.templates[alias] = tmpl
+	}
+	return t, nil
+}
+
+func loadTemplate(fsys fs.FS, dir string, htmlLayout *htmltemplate.Template, textLayout *texttemplate.Template) (
+	*localTemplate, error) {
+	var tmpl localTemplate
+	data, err := fs.ReadFile(fsys, path.Join(dir, "subject.txt"))
+	if err != nil {
+		return nil, err
+	}
+	if tmpl.subject, err = texttemplate.New("subject").Option("missingkey=error").Parse(string(data)); err != nil {
+		return nil, err
+	}
+
+	if data, err = fs.ReadFile(fsys, path.Join(dir, "body.html")); err != nil {
+		return nil, err
+	}
+	if tmpl.html, err = htmlLayout.Clone(); err != nil {
+		return nil, err
+	}
+	if tmpl.html, err = tmpl.html.New("body").Parse(string(data)); err != nil {
+		return nil, err
+	}
+	tmpl.htmlEntry = entry(func(name string) bool {
+		t := tmpl.html.Lookup(name)
+		return t != nil && t.Tree != nil
+	})
+	// trees are walked before the first execution, html/template rewrites them when escaping
+	vars := make(map[string]bool)
+	collectVars(vars, tmpl.subject.Tree.Root)
+	for _, t := range tmpl.html.Templates() {
+		if t.Tree != nil {
+			collectVars(vars, t.Tree.Root)
+		}
+	}
+
+	data, err = fs.ReadFile(fsys, path.Join(dir, "body.txt"))
+	if errors.Is(err, fs.ErrNotExist) {
+		tmpl.vars = sortedKeys(vars)
+		return &tmpl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tmpl.text, err = textLayout.Clone(); err != nil {
+		return nil, err
+	}
+	if tmpl.text, err = tmpl.text.New("body").Parse(string(data)); err != nil {
+		return nil, err
+	}
+	tmpl.textEntry = entry(func(name string) bool {
+		t := tmpl.text.Lookup(name)
+		return t != nil && t.Tree != nil
+	})
+	for _, t := range tmpl.text.Templates() {
+		if t.Tree != nil {
+			collectVars(vars, t.Tree.Root)
+		}
+	}
+	tmpl.vars = sortedKeys(vars)
+	return &tmpl, nil
+}
+
+// Has reports whether template alias is registered
+func (t *Templates) Has(alias string) bool {
+	_, ok := t.templates[alias]
+	return ok
+}
+
+// Vars returns sorted list of top level model variables used by template alias
+func (t *Templates) Vars(alias string) []string {
+	tmpl, ok := t.templates[alias]
+	if !ok {
+		return nil
+	}
+	return append([]string(nil), tmpl.vars...)
+}
+
+// Aliases returns sorted list of registered templates
+func (t *Templates) Aliases() []string {
+	res := make([]string, 0, len(t.templates))
+	for alias := range t.templates {
+		res = append(res, alias)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func sortedKeys(m map[string]bool) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Render executes template alias with model, textBody is empty if template has no body.txt
+func (t *Templates) Render(alias string, model map[string]interface{}) (subject, htmlBody, textBody string, err error) {
+	tmpl, ok := t.templates[alias]
+	if !ok {
+		return "", "", "", fmt.Errorf("%w: %s", ErrTemplateNotFound, alias)
+	}
+	var buf bytes.Buffer
+	if err = tmpl.subject.Execute(&buf, model); err != nil {
+		return "", "", "", fmt.Errorf("subject: %w", err)
+	}
+	subject = strings.TrimSpace(buf.String())
+
+	buf.Reset()
+	if err = tmpl.html.ExecuteTemplate(&buf, tmpl.htmlEntry, model); err != nil {
+		return "", "", "", fmt.Errorf("body.html: %w", err)
+	}
+	htmlBody = buf.String()
+
+	if tmpl.text != nil {
+		buf.Reset()
+		if err = tmpl.text.ExecuteTemplate(&buf, tmpl.textEntry, model); err != nil {
+			return "", "", "", fmt.Errorf("body.txt: %w", err)
+		}
+		textBody = strings.TrimSpace(buf.String())
+	}
+	return subject, htmlBody, textBody, nil
+}
+
+// RenderEmail renders email.TemplateAlias with email.TemplateModel, it may be used as RenderFunc
+func (t *Templates) RenderEmail(email Email) (subject, htmlBody, textBody string, err error) {
+	return t.Render(email.TemplateAlias, email.TemplateModel)
+}
+
+// entry returns "layout" when body defines "content" to be rendered inside of the layout
+func entry(lookup func(name string) bool) string {
+	if lookup("content") && lookup("layout") {
+		return "layout"
+	}
+	return "body"
+}
+
+// collectVars adds fields of the model (.name and $.name) referenced by node to vars.
+// Bodies of range and with blocks are skipped, the dot is not the model there.
+func collectVars(vars map[string]bool, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			collectVars(vars, c)
+		}
+	case *parse.ActionNode:
+		collectVars(vars, n.Pipe)
+	case *parse.IfNode:
+		collectVars(vars, n.Pipe)
+		collectVars(vars, n.List)
+		collectVars(vars, n.ElseList)
+	case *parse.RangeNode:
+		collectVars(vars, n.Pipe)
+		collectVars(vars, n.ElseList)
+	case *parse.WithNode:
+		collectVars(vars, n.Pipe)
+		collectVars(vars, n.ElseList)
+	case *parse.TemplateNode:
+		collectVars(vars, n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			for _, arg := range cmd.Args {
+				collectVars(vars, arg)
+			}
+		}
+	case *parse.ChainNode:
+		collectVars(vars, n.Node)
+	case *parse.FieldNode:
+		vars[n.Ident[0]] = true
+	case *parse.VariableNode:
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			vars[n.Ident[1]] = true
+		}
+	}
+}
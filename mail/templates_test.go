@@ -0,0 +1,47 @@
+package mail
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultTemplates(t *testing.T) {
+	templates := DefaultTemplates()
+	require.Equal(t, []string{CopyStartedTmpl, CopyStoppedTmpl, DepositTmpl, DestroyAccountCodeTmpl, DrawdownTmpl,
+		MarginCallTmpl, PasswordResetTmpl, StopLossTmpl, StopLossDigestTmpl, StrategyPausedTmpl, TakeProfitTmpl, VerificationCodeTmpl,
+		WithdrawalTmpl}, templates.Aliases())
+
+	outbox := NewOutbox()
+	s := New(outbox, testConfig, WithTemplates(templates))
+	require.NoError(t, s.SendNotificationStopLoss(context.TODO(), "investor@ditto.trade", "Alpha <Fund>", uuid.New(),
+		900, 1000))
+	email, ok := outbox.AssertSent(t, StopLossTmpl, "investor@ditto.trade")
+	require.True(t, ok)
+	require.True(t, email.Rendered())
+	require.Equal(t, "Stop loss reached: Alpha <Fund>", email.Subject)
+	require.Contains(t, email.HTMLBody, "Alpha &lt;Fund&gt;")
+	require.Contains(t, email.HTMLBody, testConfig.CompanyAddress)
+	require.Contains(t, email.TextBody, "Stop loss: 1,000.00")
+}
+
+func TestTemplates_MissingKey(t *testing.T) {
+	templates, err := LoadTemplates(fstest.MapFS{
+		"hello/subject.txt": {Data: []byte("Hello {{.name}}")},
+		"hello/body.html":   {Data: []byte("<p>Hello {{.name}}</p>")},
+	})
+	require.NoError(t, err)
+	subject, htmlBody, textBody, err := templates.Render("hello", map[string]interface{}{"name": "Bob"})
+	require.NoError(t, err)
+	require.Equal(t, "Hello Bob", subject)
+	require.Equal(t, "<p>Hello Bob</p>", htmlBody)
+	require.Empty(t, textBody)
+
+	_, _, _, err = templates.Render("hello", map[string]interface{}{})
+	require.Error(t, err)
+	_, _, _, err = templates.Render("bye", nil)
+	require.ErrorIs(t, err, ErrTemplateNotFound)
+}
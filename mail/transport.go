@@ -0,0 +1,222 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/dittotrade/internal/utils"
+	"github.com/keighl/postmark"
+)
+
+type (
+	// Transport delivers emails prepared by Service.
+	// Implementations must be safe for concurrent use and should stop when ctx is done.
+	Transport interface {
+		Send(ctx context.Context, email Email) (Response, error)
+	}
+
+	// Email is handed over to a Transport.
+	// It is sent as is when it is Rendered, otherwise transport renders TemplateAlias.
+	Email struct {
+		// TemplateAlias identifies the template to render
+		TemplateAlias string
+		// TemplateModel is the merged template data (Config defaults + custom data)
+		TemplateModel map[string]interface{}
+		From          string
+		To            string
+		ReplyTo       string
+		Tag           string
+		InlineCSS     bool
+		TrackOpens    bool
+		// Subject, HTMLBody and TextBody are set when template is rendered locally
+		Subject     string
+		HTMLBody    string
+		TextBody    string
+		Attachments []Attachment
+		// MessageStream is Postmark message stream, default transactional stream if empty
+		MessageStream string
+		// Metadata correlates provider events with our entities, e.g. user_id or strategy_id
+		Metadata map[string]string
+	}
+
+	// Response is returned by Transport on successful delivery
+	Response struct {
+		To          string
+		MessageID   string
+		SubmittedAt time.Time
+	}
+
+	// PostmarkTransport sends emails using Postmark templates or raw when email is Rendered.
+	// postmark.Client does not support context, so requests are made
+	// by the transport itself reusing client tokens, BaseURL and HTTPClient.
+	PostmarkTransport struct {
+		client *postmark.Client
+	}
+
+	// postmarkEmail and postmarkTemplatedEmail add fields missing in postmark.Email and postmark.TemplatedEmail
+	postmarkEmail struct {
+		postmark.Email
+		MessageStream string `json:",omitempty"`
+	}
+
+	postmarkTemplatedEmail struct {
+		postmark.TemplatedEmail
+		Metadata      map[string]string `json:",omitempty"`
+		MessageStream string            `json:",omitempty"`
+	}
+)
+
+// NewPostmarkTransport creates Transport which sends emails via Postmark API
+func NewPostmarkTransport(serverToken, accountToken string) *PostmarkTransport {
+	return NewPostmarkClientTransport(postmark.NewClient(serverToken, accountToken))
+}
+
+// NewPostmarkClientTransport creates Transport using tokens, BaseURL and HTTPClient of client
+func NewPostmarkClientTransport(client *postmark.Client) *PostmarkTransport {
+	return &PostmarkTransport{client: client}
+}
+
+// Rendered reports whether email has bodies and does not need template rendering
+func (e Email) Rendered() bool {
+	return e.HTMLBody != "" || e.TextBody != ""
+}
+
+// Send email using Postmark template referenced by email.TemplateAlias
+func (t *PostmarkTransport) Send(ctx context.Context, email Email) (Response, error) {
+	var res postmark.EmailResponse
+	var err error
+	if email.Rendered() {
+		err = t.do(ctx, "email", newPostmarkEmail(email), &res)
+	} else {
+		err = t.do(ctx, "email/withTemplate", newPostmarkTemplatedEmail(email), &res)
+	}
+	if err != nil {
+		return Response{}, fmt.Errorf("postmark: %w", err)
+	}
+	return Response{To: res.To, MessageID: res.MessageID, SubmittedAt: res.SubmittedAt}, nil
+}
+
+// SendBatch sends up to PostmarkBatchLimit emails,
+// rendered and templated emails are sent by separate requests
+func (t *PostmarkTransport) SendBatch(ctx context.Context, emails []Email) ([]BatchResult, error) {
+	if len(emails) > PostmarkBatchLimit {
+		return nil, fmt.Errorf("postmark: batch of %d emails exceeds limit of %d", len(emails), PostmarkBatchLimit)
+	}
+	results := make([]BatchResult, len(emails))
+	var raw, templated []int
+	var rawPayload []postmarkEmail
+	var templatedPayload []postmarkTemplatedEmail
+	for i, email := range emails {
+		if email.Rendered() {
+			raw = append(raw, i)
+			rawPayload = append(rawPayload, newPostmarkEmail(email))
+		} else {
+			templated = append(templated, i)
+			templatedPayload = append(templatedPayload, newPostmarkTemplatedEmail(email))
+		}
+	}
+	if len(raw) > 0 {
+		var res []postmark.EmailResponse
+		err := t.do(ctx, "email/batch", rawPayload, &res)
+		batchResults(results, raw, res, err)
+	}
+	if len(templated) > 0 {
+		var res []postmark.EmailResponse
+		err := t.do(ctx, "email/batchWithTemplates", map[string]interface{}{"Messages": templatedPayload}, &res)
+		batchResults(results, templated, res, err)
+	}
+	return results, nil
+}
+
+// batchResults fills results of emails at indices from Postmark batch response
+func batchResults(results []BatchResult, indices []int, res []postmark.EmailResponse, err error) {
+	if err == nil && len(res) != len(indices) {
+		err = fmt.Errorf("got %d results for %d emails", len(res), len(indices))
+	}
+	for j, i := range indices {
+		switch {
+		case err != nil:
+			results[i].Err = fmt.Errorf("postmark: %w", err)
+		case res[j].ErrorCode != 0:
+			results[i].Err = fmt.Errorf("postmark: %w", postmarkError(http.StatusUnprocessableEntity,
+				postmark.APIError{ErrorCode: res[j].ErrorCode, Message: res[j].Message}))
+		default:
+			results[i].Response = Response{To: res[j].To, MessageID: res[j].MessageID, SubmittedAt: res[j].SubmittedAt}
+		}
+	}
+}
+
+func newPostmarkEmail(email Email) postmarkEmail {
+	return postmarkEmail{
+		Email: postmark.Email{
+			From:        email.From,
+			To:          email.To,
+			Subject:     email.Subject,
+			Tag:         email.Tag,
+			HtmlBody:    email.HTMLBody,
+			TextBody:    email.TextBody,
+			ReplyTo:     email.ReplyTo,
+			TrackOpens:  email.TrackOpens,
+			Attachments: postmarkAttachments(email.Attachments),
+			Metadata:    email.Metadata,
+		},
+		MessageStream: email.MessageStream,
+	}
+}
+
+func newPostmarkTemplatedEmail(email Email) postmarkTemplatedEmail {
+	return postmarkTemplatedEmail{
+		TemplatedEmail: postmark.TemplatedEmail{
+			TemplateAlias: email.TemplateAlias,
+			TemplateModel: email.TemplateModel,
+			InlineCss:     email.InlineCSS,
+			TrackOpens:    email.TrackOpens,
+			From:          email.From,
+			To:            email.To,
+			Tag:           email.Tag,
+			ReplyTo:       email.ReplyTo,
+			Attachments:   postmarkAttachments(email.Attachments),
+		},
+		Metadata:      email.Metadata,
+		MessageStream: email.MessageStream,
+	}
+}
+
+// do posts payload to Postmark API path and decodes response into dst.
+// Postmark errors are returned as *SendError wrapping postmark.APIError.
+func (t *PostmarkTransport) do(ctx context.Context, path string, payload, dst interface{}) (err error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.client.BaseURL+"/"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Postmark-Server-Token", t.client.ServerToken)
+	res, err := t.client.HTTPClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return &SendError{Kind: ErrTransient, Err: err}
+	}
+	defer utils.CloseOrErr(res.Body, &err)
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return &SendError{StatusCode: res.StatusCode, Kind: ErrTransient, Err: err}
+	}
+	if res.StatusCode != http.StatusOK {
+		apiErr := postmark.APIError{Message: res.Status}
+		_ = json.Unmarshal(data, &apiErr)
+		return postmarkError(res.StatusCode, apiErr)
+	}
+	return json.Unmarshal(data, dst)
+}
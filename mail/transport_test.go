@@ -0,0 +1,74 @@
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/keighl/postmark"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostmarkTransport_Send(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "server-token", r.Header.Get("X-Postmark-Server-Token"))
+		var email postmark.TemplatedEmail
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&email))
+		if r.URL.Path == "/email" {
+			_ = json.NewEncoder(w).Encode(postmark.EmailResponse{To: email.To, MessageID: "raw-message-id"})
+			return
+		}
+		require.Equal(t, "/email/withTemplate", r.URL.Path)
+		if email.To == "inactive@ditto.trade" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_, _ = w.Write([]byte(`{"ErrorCode":406,"Message":"You tried to send to a recipient that has been marked as inactive."}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(postmark.EmailResponse{To: email.To, MessageID: "message-id"})
+	}))
+	defer srv.Close()
+	tr := NewPostmarkTransport("server-token", "account-token")
+	tr.client.BaseURL = srv.URL
+
+	res, err := tr.Send(context.TODO(), Email{TemplateAlias: VerificationCodeTmpl, To: "user01@ditto.trade"})
+	require.NoError(t, err)
+	require.Equal(t, "message-id", res.MessageID)
+
+	res, err = tr.Send(context.TODO(), Email{To: "user01@ditto.trade", Subject: "Hi", HTMLBody: "<p>Hi</p>"})
+	require.NoError(t, err)
+	require.Equal(t, "raw-message-id", res.MessageID)
+
+	_, err = tr.Send(context.TODO(), Email{TemplateAlias: VerificationCodeTmpl, To: "inactive@ditto.trade"})
+	var apiErr postmark.APIError
+	require.True(t, errors.As(err, &apiErr))
+	require.Equal(t, int64(406), apiErr.ErrorCode)
+	require.ErrorIs(t, err, ErrInactiveRecipient)
+	require.False(t, IsRetryable(err))
+}
+
+func TestPostmarkError(t *testing.T) {
+	tests := []struct {
+		status int
+		code   int64
+		msg    string
+		want   error
+	}{
+		{http.StatusUnprocessableEntity, 300, "Error parsing 'To': Illegal email address 'x'.", ErrInvalidRecipient},
+		{http.StatusUnprocessableEntity, 406, "inactive", ErrInactiveRecipient},
+		{http.StatusUnprocessableEntity, 1101, "template not found", ErrTemplateNotFound},
+		{http.StatusTooManyRequests, 0, "rate limit exceeded", ErrRateLimited},
+		{http.StatusServiceUnavailable, 0, "unavailable", ErrTransient},
+		{http.StatusUnauthorized, 10, "bad token", nil},
+	}
+	for _, tt := range tests {
+		err := postmarkError(tt.status, postmark.APIError{ErrorCode: tt.code, Message: tt.msg})
+		if tt.want == nil {
+			require.Nil(t, err.Kind, tt.msg)
+			continue
+		}
+		require.ErrorIs(t, err, tt.want, tt.msg)
+	}
+}
@@ -0,0 +1,167 @@
+package mail
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Postmark webhook record types, see https://postmarkapp.com/developer/webhooks/webhooks-overview
+const (
+	RecordTypeBounce        = "Bounce"
+	RecordTypeSpamComplaint = "SpamComplaint"
+	RecordTypeDelivery      = "Delivery"
+	RecordTypeOpen          = "Open"
+)
+
+// suppressedBounceTypes are permanent failures, soft bounces and delays are ignored
+var suppressedBounceTypes = map[string]bool{
+	"HardBounce":          true,
+	"BadEmailAddress":     true,
+	"SpamComplaint":       true,
+	"ManuallyDeactivated": true,
+}
+
+type (
+	// WebhookEvent is a subset of Postmark webhook payload fields
+	WebhookEvent struct {
+		RecordType  string
+		Type        string
+		MessageID   string
+		Email       string
+		Tag         string
+		Description string
+		Inactive    bool
+		BouncedAt   time.Time
+		// Recipient, DeliveredAt, ReceivedAt and Details are set by Delivery and Open webhooks
+		Recipient   string
+		DeliveredAt time.Time
+		ReceivedAt  time.Time
+		Details     string
+		FirstOpen   bool
+		Metadata    map[string]string
+	}
+
+	// WebhookHandler receives Postmark Bounce and SpamComplaint webhooks
+	// and adds permanently failed recipients to SuppressionList.
+	// With DeliveryTracker it also records Delivery, Open, Bounce and SpamComplaint events.
+	// Postmark must be configured to send webhooks with basic auth credentials.
+	WebhookHandler struct {
+		username     string
+		password     string
+		suppressions SuppressionList
+		tracker      DeliveryTracker
+	}
+)
+
+// NewWebhookHandler creates http.Handler of Postmark webhooks protected by basic auth
+func NewWebhookHandler(suppressions SuppressionList, username, password string) *WebhookHandler {
+	return &WebhookHandler{username: username, password: password, suppressions: suppressions}
+}
+
+// WithDeliveryTracker makes handler update delivery status of sent emails, e.g. in PostgresAuditLog
+func (h *WebhookHandler) WithDeliveryTracker(tracker DeliveryTracker) *WebhookHandler {
+	h.tracker = tracker
+	return h
+}
+
+// ServeHTTP responds with non 2xx status if event could not be stored, Postmark retries such webhooks
+func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="postmark"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var event WebhookEvent
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&event); err != nil {
+		http.Error(w, "malformed webhook payload", http.StatusBadRequest)
+		return
+	}
+	if err := h.track(r.Context(), event); err != nil {
+		log.Printf("mail webhook: %s", err)
+		http.Error(w, "could not store event", http.StatusInternalServerError)
+		return
+	}
+	if !suppresses(event) || h.suppressions == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err := h.suppressions.Suppress(r.Context(), Suppression{
+		Email:        event.Email,
+		Reason:       event.Type,
+		Description:  event.Description,
+		MessageID:    event.MessageID,
+		SuppressedAt: event.BouncedAt,
+	}); err != nil {
+		log.Printf("mail webhook: %s", err)
+		http.Error(w, "could not store event", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// track updates delivery status of the email referenced by event
+func (h *WebhookHandler) track(ctx context.Context, event WebhookEvent) error {
+	if h.tracker == nil || event.MessageID == "" {
+		return nil
+	}
+	status, at, details := deliveryStatus(event)
+	if status == "" {
+		return nil
+	}
+	return h.tracker.UpdateStatus(ctx, event.MessageID, status, at, details)
+}
+
+// deliveryStatus maps webhook event to audit status, repeated opens are ignored
+func deliveryStatus(event WebhookEvent) (status string, at time.Time, details string) {
+	switch event.RecordType {
+	case RecordTypeDelivery:
+		return AuditStatusDelivered, event.DeliveredAt, event.Details
+	case RecordTypeOpen:
+		if !event.FirstOpen {
+			return "", time.Time{}, ""
+		}
+		return AuditStatusOpened, event.ReceivedAt, ""
+	case RecordTypeBounce:
+		return AuditStatusBounced, event.BouncedAt, strings.TrimSpace(event.Type + ": " + event.Description)
+	case RecordTypeSpamComplaint:
+		return AuditStatusSpamComplaint, event.BouncedAt, event.Description
+	default:
+		return "", time.Time{}, ""
+	}
+}
+
+func (h *WebhookHandler) authorized(r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	if !ok || h.password == "" {
+		return false
+	}
+	// both comparisons are evaluated to keep timing independent of which one fails
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(h.username))
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(h.password))
+	return userOK&passOK == 1
+}
+
+// suppresses reports whether event means that recipient must not receive emails anymore
+func suppresses(event WebhookEvent) bool {
+	if event.Email == "" {
+		return false
+	}
+	switch event.RecordType {
+	case RecordTypeSpamComplaint:
+		return true
+	case RecordTypeBounce:
+		return event.Inactive || suppressedBounceTypes[event.Type]
+	default:
+		return false
+	}
+}
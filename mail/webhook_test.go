@@ -0,0 +1,111 @@
+package mail
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// memorySuppressions is SuppressionList for tests without Postgres
+type memorySuppressions struct {
+	mu   sync.Mutex
+	list map[string]Suppression
+}
+
+func (m *memorySuppressions) IsSuppressed(_ context.Context, email string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.list[normalizeEmail(email)]
+	return ok, nil
+}
+
+func (m *memorySuppressions) Suppress(_ context.Context, s Suppression) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.list == nil {
+		m.list = make(map[string]Suppression)
+	}
+	m.list[normalizeEmail(s.Email)] = s
+	return nil
+}
+
+func TestWebhookHandler(t *testing.T) {
+	list := &memorySuppressions{}
+	h := NewWebhookHandler(list, "postmark", "secret")
+	post := func(body string, auth bool) int {
+		r := httptest.NewRequest(http.MethodPost, "/webhooks/postmark", strings.NewReader(body))
+		if auth {
+			r.SetBasicAuth("postmark", "secret")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	hardBounce := `{"RecordType":"Bounce","Type":"HardBounce","TypeCode":1,"MessageID":"m1",
+		"Email":"Bounced@ditto.trade","BouncedAt":"2019-11-05T16:33:54.9070259Z","Inactive":true}`
+	require.Equal(t, http.StatusUnauthorized, post(hardBounce, false))
+	require.Empty(t, list.list)
+
+	require.Equal(t, http.StatusOK, post(hardBounce, true))
+	require.Equal(t, "HardBounce", list.list["bounced@ditto.trade"].Reason)
+
+	require.Equal(t, http.StatusOK, post(`{"RecordType":"Bounce","Type":"SoftBounce",
+		"Email":"soft@ditto.trade","Inactive":false}`, true))
+	require.Equal(t, http.StatusOK, post(`{"RecordType":"SpamComplaint","Type":"SpamComplaint",
+		"Email":"spam@ditto.trade","BouncedAt":"2019-11-05T16:33:54Z"}`, true))
+	require.Len(t, list.list, 2)
+	require.Contains(t, list.list, "spam@ditto.trade")
+
+	require.Equal(t, http.StatusBadRequest, post(`{`, true))
+}
+
+func TestService_Suppressed(t *testing.T) {
+	list := &memorySuppressions{}
+	require.NoError(t, list.Suppress(context.TODO(), Suppression{Email: "bounced@ditto.trade", Reason: "HardBounce"}))
+	outbox := NewOutbox()
+	s := New(outbox, testConfig, WithSuppressionList(list))
+
+	err := s.SendNotificationStopLoss(context.TODO(), "Bounced@ditto.trade", "Alpha", uuid.New(), 900, 1000)
+	require.ErrorIs(t, err, ErrSuppressed)
+	require.False(t, IsRetryable(err))
+	err = s.SendNotificationStopLoss(context.TODO(), "Investor <bounced@ditto.trade>", "Alpha", uuid.New(), 900, 1000)
+	require.ErrorIs(t, err, ErrSuppressed)
+	err = s.SendNotificationStopLoss(context.TODO(), "bounced@ditto.trade, ok@ditto.trade", "Alpha", uuid.New(),
+		900, 1000)
+	require.ErrorIs(t, err, ErrInvalidRecipient)
+	require.Zero(t, outbox.Len())
+
+	require.NoError(t, s.SendVerificationCode(context.TODO(), "bounced@ditto.trade", "111111", WithCritical()))
+	require.Equal(t, 1, outbox.Len())
+}
+
+func TestPostgresSuppressionList(t *testing.T) {
+	database := openTestDB(t)
+	ctx := context.TODO()
+	require.NoError(t, CreateSuppressionTable(ctx, database))
+	list := NewPostgresSuppressionList(database)
+	email := "suppressed-" + uuid.NewString() + "@ditto.trade"
+	defer func() { _ = list.Unsuppress(ctx, email) }()
+
+	suppressed, err := list.IsSuppressed(ctx, email)
+	require.NoError(t, err)
+	require.False(t, suppressed)
+
+	require.NoError(t, list.Suppress(ctx, Suppression{Email: strings.ToUpper(email), Reason: "HardBounce"}))
+	require.NoError(t, list.Suppress(ctx, Suppression{Email: email, Reason: "SpamComplaint"}))
+	suppressed, err = list.IsSuppressed(ctx, email)
+	require.NoError(t, err)
+	require.True(t, suppressed)
+
+	require.NoError(t, list.Unsuppress(ctx, email))
+	suppressed, err = list.IsSuppressed(ctx, email)
+	require.NoError(t, err)
+	require.False(t, suppressed)
+}
@@ -0,0 +1,290 @@
+// Package otp issues and verifies one-time passwords of verification, password reset and destroy account flows.
+// Only keyed hashes of codes are stored, verification is limited by attempts and expiry.
+package otp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/dittotrade/internal/db"
+	"github.com/dittotrade/internal/mail"
+)
+
+// Schema creates table used by Manager
+const Schema = `
+create table if not exists otp_codes (
+	id          bigserial primary key,
+	subject     text not null,
+	purpose     text not null,
+	code_hash   bytea not null,
+	attempts    int not null default 0,
+	expires_at  timestamptz not null,
+	created_at  timestamptz not null default now(),
+	consumed_at timestamptz
+);
+create index if not exists otp_codes_subject_idx on otp_codes (subject, purpose, created_at) where consumed_at is null;
+`
+
+// Purposes of codes delivered by Manager.Send, other purposes may be issued and verified as well
+const (
+	PurposeVerification   = "verification"
+	PurposePasswordReset  = "password_reset"
+	PurposeDestroyAccount = "destroy_account"
+)
+
+// Defaults of Config
+const (
+	DefaultLength      = 6
+	DefaultTTL         = 10 * time.Minute
+	DefaultMaxAttempts = 5
+)
+
+// Verification errors, check them with errors.Is
+var (
+	// ErrNotFound means subject has no active code of the purpose: it was never issued, used or replaced
+	ErrNotFound = errors.New("otp code not found")
+	// ErrExpired means the latest code is expired, a new one must be issued
+	ErrExpired = errors.New("otp code expired")
+	// ErrInvalidCode means code does not match, the attempt is counted
+	ErrInvalidCode = errors.New("invalid otp code")
+	// ErrLocked means code is locked after Config.MaxAttempts failed attempts, a new one must be issued
+	ErrLocked = errors.New("otp code locked")
+	// ErrUnknownPurpose means Manager.Send has no mail.Service method for purpose
+	ErrUnknownPurpose = errors.New("unknown otp purpose")
+)
+
+// senders deliver codes by purpose
+var senders = map[string]func(*mail.Service, context.Context, string, string, ...mail.SendOption) error{
+	PurposeVerification:   (*mail.Service).SendVerificationCode,
+	PurposePasswordReset:  (*mail.Service).SendResetPasswordCode,
+	PurposeDestroyAccount: (*mail.Service).SendDestroyAccountCode,
+}
+
+type (
+	// Config of Manager, zero values are replaced by defaults
+	Config struct {
+		// Secret keys hashes of codes, short numeric codes must not be stored with plain hashes
+		Secret string
+		// Length is the number of digits, DefaultLength if zero
+		Length int
+		// TTL is a lifetime of code, DefaultTTL if zero
+		TTL time.Duration
+		// MaxAttempts is the number of verifications of a code, DefaultMaxAttempts if zero
+		MaxAttempts int
+	}
+
+	// Option configures Manager
+	Option func(*Manager)
+
+	// Manager issues codes and verifies them against otp_codes table
+	Manager struct {
+		db     *sql.DB
+		config Config
+		mailer *mail.Service
+	}
+)
+
+// WithMailer makes Manager.Send deliver codes through mail Service
+func WithMailer(mailer *mail.Service) Option {
+	return func(m *Manager) {
+		m.mailer = mailer
+	}
+}
+
+// CreateTable creates otp_codes table if it does not exist
+func CreateTable(ctx context.Context, dbtx db.DBTX) error {
+	if _, err := dbtx.ExecContext(ctx, Schema); err != nil {
+		return fmt.Errorf("could not create otp_codes: %w", err)
+	}
+	return nil
+}
+
+// NewManager creates Manager, config must have Secret
+func NewManager(database *sql.DB, config Config, opts ...Option) (*Manager, error) {
+	if config.Secret == "" {
+		return nil, errors.New("otp: Secret is required")
+	}
+	if config.Length == 0 {
+		config.Length = DefaultLength
+	}
+	if config.TTL == 0 {
+		config.TTL = DefaultTTL
+	}
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = DefaultMaxAttempts
+	}
+	if config.Length < 4 || config.Length > 18 || config.TTL < 0 || config.MaxAttempts < 0 {
+		return nil, fmt.Errorf("otp: invalid config: Length %d, TTL %s, MaxAttempts %d",
+			config.Length, config.TTL, config.MaxAttempts)
+	}
+	m := &Manager{db: database, config: config}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m, nil
+}
+
+// Issue generates code of purpose for subject (e.g. email or user id) and stores its hash.
+// Previous active codes of the subject and purpose are replaced.
+func (m *Manager) Issue(ctx context.Context, purpose, subject string) (code string, err error) {
+	subject = normalizeSubject(subject)
+	err = db.Transaction(m.db)(func(tx db.DBTX) error {
+		id, issued, err := m.insert(ctx, tx, purpose, subject)
+		if err != nil {
+			return err
+		}
+		code = issued
+		return m.replace(ctx, tx, purpose, subject, id)
+	})
+	return code, err
+}
+
+// Send issues code of purpose for email and delivers it with the matching mail.Service method.
+// Previous codes are replaced only after the new one is sent, the new one is revoked if it could not be sent.
+func (m *Manager) Send(ctx context.Context, purpose, email string, opts ...mail.SendOption) error {
+	send, ok := senders[purpose]
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownPurpose, purpose)
+	}
+	if m.mailer == nil {
+		return errors.New("otp: Manager has no mailer, see WithMailer")
+	}
+	subject := normalizeSubject(email)
+	id, code, err := m.insert(ctx, m.db, purpose, subject)
+	if err != nil {
+		return err
+	}
+	if err = send(m.mailer, ctx, email, code, opts...); err != nil {
+		// ctx may be expired, the code must be revoked anyway
+		if _, revokeErr := m.db.ExecContext(context.Background(), `UPDATE otp_codes SET consumed_at = now()
+			WHERE id = $1 AND consumed_at IS NULL`, id); revokeErr != nil {
+			return fmt.Errorf("%w (could not revoke code: %s)", err, revokeErr)
+		}
+		return err
+	}
+	return m.replace(ctx, m.db, purpose, subject, id)
+}
+
+// insert generates code and stores its hash, it returns id of the code
+func (m *Manager) insert(ctx context.Context, dbtx db.DBTX, purpose, subject string) (int64, string, error) {
+	code, err := generateCode(m.config.Length)
+	if err != nil {
+		return 0, "", fmt.Errorf("could not generate otp code: %w", err)
+	}
+	var id int64
+	if err = dbtx.QueryRowContext(ctx, `INSERT INTO otp_codes(subject, purpose, code_hash, expires_at)
+		VALUES ($1,$2,$3,now() + $4::bigint * interval '1 millisecond') RETURNING id`,
+		subject, purpose, m.hash(purpose, subject, code), m.config.TTL.Milliseconds()).Scan(&id); err != nil {
+		return 0, "", fmt.Errorf("could not store otp code: %w", err)
+	}
+	return id, code, nil
+}
+
+// replace consumes active codes of subject and purpose issued before code id
+func (m *Manager) replace(ctx context.Context, dbtx db.DBTX, purpose, subject string, id int64) error {
+	if _, err := dbtx.ExecContext(ctx, `UPDATE otp_codes SET consumed_at = now()
+		WHERE subject = $1 AND purpose = $2 AND consumed_at IS NULL AND id < $3`, subject, purpose, id); err != nil {
+		return fmt.Errorf("could not replace otp codes: %w", err)
+	}
+	return nil
+}
+
+// Verify consumes the latest code of purpose issued for subject if it matches code.
+// Every verification counts as an attempt before comparison, so concurrent guesses cannot exceed
+// Config.MaxAttempts. The last failed attempt returns ErrLocked.
+func (m *Manager) Verify(ctx context.Context, purpose, subject, code string) error {
+	subject = normalizeSubject(subject)
+	var id int64
+	var hash []byte
+	var attempts int
+	err := m.db.QueryRowContext(ctx, `UPDATE otp_codes SET attempts = attempts + 1
+		WHERE id = (SELECT id FROM otp_codes WHERE subject = $1 AND purpose = $2 AND consumed_at IS NULL
+			ORDER BY created_at DESC, id DESC LIMIT 1)
+		AND attempts < $3 AND expires_at > now()
+		RETURNING id, code_hash, attempts`, subject, purpose, m.config.MaxAttempts).Scan(&id, &hash, &attempts)
+	if db.IsNotFoundError(err) {
+		return m.inactive(ctx, purpose, subject)
+	}
+	if err != nil {
+		return fmt.Errorf("could not verify otp code: %w", err)
+	}
+	if !hmac.Equal(hash, m.hash(purpose, subject, strings.TrimSpace(code))) {
+		if attempts >= m.config.MaxAttempts {
+			return ErrLocked
+		}
+		return ErrInvalidCode
+	}
+	res, err := m.db.ExecContext(ctx, `UPDATE otp_codes SET consumed_at = now() WHERE id = $1
+		AND consumed_at IS NULL`, id)
+	if err != nil {
+		return fmt.Errorf("could not consume otp code: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		// code is consumed or replaced concurrently
+		return ErrNotFound
+	}
+	return nil
+}
+
+// inactive explains why the latest code of subject cannot be verified
+func (m *Manager) inactive(ctx context.Context, purpose, subject string) error {
+	var attempts int
+	var expired bool
+	err := m.db.QueryRowContext(ctx, `SELECT attempts, expires_at <= now() FROM otp_codes
+		WHERE subject = $1 AND purpose = $2 AND consumed_at IS NULL ORDER BY created_at DESC, id DESC LIMIT 1`,
+		subject, purpose).Scan(&attempts, &expired)
+	switch {
+	case db.IsNotFoundError(err):
+		return ErrNotFound
+	case err != nil:
+		return fmt.Errorf("could not verify otp code: %w", err)
+	case attempts >= m.config.MaxAttempts:
+		return ErrLocked
+	case expired:
+		return ErrExpired
+	default:
+		// code is replaced concurrently
+		return ErrNotFound
+	}
+}
+
+// Cleanup deletes codes which expired or were consumed before olderThan
+func (m *Manager) Cleanup(ctx context.Context, olderThan time.Duration) (int64, error) {
+	res, err := m.db.ExecContext(ctx, `DELETE FROM otp_codes
+		WHERE coalesce(consumed_at, expires_at) < now() - $1::bigint * interval '1 millisecond'`,
+		olderThan.Milliseconds())
+	if err != nil {
+		return 0, fmt.Errorf("could not clean up otp codes: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// hash keys code with Secret, purpose and subject so that a code cannot be reused for another flow
+func (m *Manager) hash(purpose, subject, code string) []byte {
+	mac := hmac.New(sha256.New, []byte(m.config.Secret))
+	mac.Write([]byte(purpose + "\x00" + subject + "\x00" + code))
+	return mac.Sum(nil)
+}
+
+// generateCode returns uniformly random code of length digits
+func generateCode(length int) (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(length)), nil)
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	code := n.String()
+	return strings.Repeat("0", length-len(code)) + code, nil
+}
+
+func normalizeSubject(subject string) string {
+	return strings.ToLower(strings.TrimSpace(subject))
+}
@@ -0,0 +1,165 @@
+package otp
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dittotrade/internal/mail"
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	dbUrl := os.Getenv("DATABASE_URL")
+	if dbUrl == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+	database, err := sql.Open("postgres", dbUrl)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = database.Close() })
+	return database
+}
+
+var testMailConfig = mail.Config{
+	ProductName:  "Ditto Trade",
+	ProductURL:   "https://ditto.trade",
+	SupportEmail: "support@ditto.trade",
+	FromEmail:    "notifications@ditto.trade",
+}
+
+func TestGenerateCode(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		code, err := generateCode(6)
+		require.NoError(t, err)
+		require.Regexp(t, `^[0-9]{6}$`, code)
+		seen[code] = true
+	}
+	require.Greater(t, len(seen), 90)
+}
+
+func TestNewManager(t *testing.T) {
+	_, err := NewManager(nil, Config{})
+	require.Error(t, err)
+	_, err = NewManager(nil, Config{Secret: "secret", Length: 3})
+	require.Error(t, err)
+
+	m, err := NewManager(nil, Config{Secret: "secret"})
+	require.NoError(t, err)
+	require.Equal(t, Config{Secret: "secret", Length: DefaultLength, TTL: DefaultTTL,
+		MaxAttempts: DefaultMaxAttempts}, m.config)
+	// codes of other flows and subjects do not match
+	require.NotEqual(t, m.hash(PurposeVerification, "a@ditto.trade", "123456"),
+		m.hash(PurposePasswordReset, "a@ditto.trade", "123456"))
+	require.NotEqual(t, m.hash(PurposeVerification, "a@ditto.trade", "123456"),
+		m.hash(PurposeVerification, "b@ditto.trade", "123456"))
+
+	err = m.Send(context.TODO(), "login", "a@ditto.trade")
+	require.ErrorIs(t, err, ErrUnknownPurpose)
+	err = m.Send(context.TODO(), PurposeVerification, "a@ditto.trade")
+	require.Error(t, err)
+}
+
+func TestManager(t *testing.T) {
+	database := openTestDB(t)
+	ctx := context.TODO()
+	require.NoError(t, CreateTable(ctx, database))
+	subject := "otp-" + uuid.NewString() + "@ditto.trade"
+	defer func() {
+		_, _ = database.ExecContext(ctx, "DELETE FROM otp_codes WHERE subject = $1", subject)
+	}()
+	m, err := NewManager(database, Config{Secret: "secret", MaxAttempts: 3})
+	require.NoError(t, err)
+
+	require.ErrorIs(t, m.Verify(ctx, PurposeVerification, subject, "000000"), ErrNotFound)
+
+	code, err := m.Issue(ctx, PurposeVerification, subject)
+	require.NoError(t, err)
+	var hash []byte
+	require.NoError(t, database.QueryRowContext(ctx, "SELECT code_hash FROM otp_codes WHERE subject = $1",
+		subject).Scan(&hash))
+	require.NotContains(t, string(hash), code)
+
+	require.ErrorIs(t, m.Verify(ctx, PurposePasswordReset, subject, code), ErrNotFound)
+	require.ErrorIs(t, m.Verify(ctx, PurposeVerification, subject, wrong(code)), ErrInvalidCode)
+	require.NoError(t, m.Verify(ctx, PurposeVerification, " "+subject, code))
+	// code is used once
+	require.ErrorIs(t, m.Verify(ctx, PurposeVerification, subject, code), ErrNotFound)
+
+	// lockout after MaxAttempts
+	code, err = m.Issue(ctx, PurposeVerification, subject)
+	require.NoError(t, err)
+	require.ErrorIs(t, m.Verify(ctx, PurposeVerification, subject, wrong(code)), ErrInvalidCode)
+	require.ErrorIs(t, m.Verify(ctx, PurposeVerification, subject, wrong(code)), ErrInvalidCode)
+	require.ErrorIs(t, m.Verify(ctx, PurposeVerification, subject, wrong(code)), ErrLocked)
+	require.ErrorIs(t, m.Verify(ctx, PurposeVerification, subject, code), ErrLocked)
+
+	// new code replaces the locked one
+	old := code
+	code, err = m.Issue(ctx, PurposeVerification, subject)
+	require.NoError(t, err)
+	if old != code {
+		require.ErrorIs(t, m.Verify(ctx, PurposeVerification, subject, old), ErrInvalidCode)
+	}
+	require.NoError(t, m.Verify(ctx, PurposeVerification, subject, code))
+
+	_, err = database.ExecContext(ctx, "UPDATE otp_codes SET expires_at = now() - interval '1 second' WHERE subject = $1",
+		subject)
+	require.NoError(t, err)
+	_, err = m.Issue(ctx, PurposeDestroyAccount, subject)
+	require.NoError(t, err)
+	_, err = database.ExecContext(ctx, `UPDATE otp_codes SET expires_at = now() - interval '1 second'
+		WHERE subject = $1 AND purpose = $2`, subject, PurposeDestroyAccount)
+	require.NoError(t, err)
+	require.ErrorIs(t, m.Verify(ctx, PurposeDestroyAccount, subject, "000000"), ErrExpired)
+}
+
+func TestManager_Send(t *testing.T) {
+	database := openTestDB(t)
+	ctx := context.TODO()
+	require.NoError(t, CreateTable(ctx, database))
+	email := "otp-" + uuid.NewString() + "@ditto.trade"
+	defer func() {
+		_, _ = database.ExecContext(ctx, "DELETE FROM otp_codes WHERE subject = $1", email)
+	}()
+	outbox := mail.NewOutbox()
+	m, err := NewManager(database, Config{Secret: "secret", TTL: time.Minute},
+		WithMailer(mail.New(outbox, testMailConfig)))
+	require.NoError(t, err)
+
+	require.NoError(t, m.Send(ctx, PurposePasswordReset, email))
+	sent, ok := outbox.AssertSent(t, mail.PasswordResetTmpl, email)
+	require.True(t, ok)
+	code, ok := sent.TemplateModel["otp"].(string)
+	require.True(t, ok)
+	require.NoError(t, m.Verify(ctx, PurposePasswordReset, email, code))
+
+	// code is revoked when it could not be sent
+	outbox.FailWith(errors.New("provider is down"))
+	require.Error(t, m.Send(ctx, PurposeDestroyAccount, email))
+	require.ErrorIs(t, m.Verify(ctx, PurposeDestroyAccount, email, "000000"), ErrNotFound)
+
+	// failed resend keeps the code which was sent before
+	outbox.FailWith(nil)
+	outbox.Reset()
+	require.NoError(t, m.Send(ctx, PurposePasswordReset, email))
+	sent, ok = outbox.AssertSent(t, mail.PasswordResetTmpl, email)
+	require.True(t, ok)
+	code = sent.TemplateModel["otp"].(string)
+	outbox.FailWith(errors.New("provider is down"))
+	require.Error(t, m.Send(ctx, PurposePasswordReset, email))
+	require.NoError(t, m.Verify(ctx, PurposePasswordReset, email, code))
+}
+
+// wrong returns another code of the same length
+func wrong(code string) string {
+	if code[0] == '0' {
+		return "1" + code[1:]
+	}
+	return "0" + code[1:]
+}